@@ -7,9 +7,11 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -19,6 +21,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/whoisnian/glb/logger"
@@ -30,8 +33,16 @@ import (
 var (
 	caCer *x509.Certificate
 	caKey crypto.Signer
+	caMu  sync.RWMutex // protects caCer and caKey from rollover at runtime
 
 	tlsCerCache *Cache
+	tlsCerStore *Store
+	leafKeys    *KeyPool
+
+	untrustedOnce sync.Once
+	untrustedCer  *x509.Certificate
+	untrustedKey  crypto.Signer
+	untrustedErr  error
 )
 
 func Setup(ctx context.Context) {
@@ -43,15 +54,47 @@ func Setup(ctx context.Context) {
 	global.LOG.Infof(ctx, "loading ca certificate from %s", fpath)
 	if err = loadFrom(fpath); err != nil && errors.Is(err, fs.ErrNotExist) {
 		global.LOG.Warn(ctx, "generating new certificate because of ErrNotExist")
-		if err = generateRoot(); err != nil {
+		if caCer, caKey, err = generateRoot("mitmproxy"); err != nil {
 			global.LOG.Fatal(ctx, "ca.generateRoot", logger.Error(err))
 		}
-		if err = saveAs(fpath); err != nil {
+		if err = saveAs(fpath, caCer, caKey); err != nil {
 			global.LOG.Fatal(ctx, "ca.saveAs", logger.Error(err))
 		}
+	} else if err != nil && errors.Is(err, errCertExpired) {
+		global.LOG.Error(ctx, "rolling over ca certificate because of errCertExpired, clients must trust the new one")
+		if err = rollover(ctx, fpath); err != nil {
+			global.LOG.Fatal(ctx, "ca.rollover", logger.Error(err))
+		}
+	} else if err != nil {
+		global.LOG.Fatal(ctx, "ca.loadFrom", logger.Error(err))
+	}
+	if err = loadPrevious(fpath + ".prev"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		global.LOG.Warn(ctx, "ca.loadPrevious", logger.Error(err))
 	}
+	global.LOG.Infof(ctx, "ca certificate sha256 fingerprint: %s", Fingerprint())
+	checkRoot(ctx, fpath)
+	go watchRoot(ctx, fpath)
 
-	tlsCerCache = NewCache(128)
+	global.LOG.Infof(ctx, "using %s keys for leaf certificates", global.CFG.LeafKeyAlg)
+	if leafKeys, err = NewKeyPool(global.CFG.LeafKeyAlg, 16); err != nil {
+		global.LOG.Fatal(ctx, "ca.NewKeyPool", logger.Error(err))
+	}
+	tlsCerCache = NewCache(global.CFG.CacheSize, global.CFG.LeafRenew)
+
+	if global.CFG.CacheDir != "" {
+		dir, err := fsutil.ExpandHomeDir(global.CFG.CacheDir)
+		if err != nil {
+			global.LOG.Fatal(ctx, "fsutil.ExpandHomeDir", logger.Error(err))
+		}
+		if tlsCerStore, err = NewStore(dir, global.CFG.StoreSize); err != nil {
+			global.LOG.Fatal(ctx, "ca.NewStore", logger.Error(err))
+		}
+		if err = tlsCerStore.LoadAll(func(name string, cer *tls.Certificate) { tlsCerCache.LoadOrStore(name, cer) }); err != nil {
+			global.LOG.Fatal(ctx, "tlsCerStore.LoadAll", logger.Error(err))
+		}
+		length, _ := tlsCerStore.Status()
+		global.LOG.Infof(ctx, "loaded %d leaf certificates from %s", length, dir)
+	}
 }
 
 // https://cs.opensource.google/go/go/+/refs/tags/go1.24.3:src/crypto/tls/tls.go;l=255
@@ -86,7 +129,7 @@ func loadFrom(certPath string) error {
 	return verify(caCer, caKey)
 }
 
-func saveAs(certPath string) error {
+func saveAs(certPath string, cer *x509.Certificate, key crypto.Signer) error {
 	if err := os.MkdirAll(filepath.Dir(certPath), osutil.DefaultDirMode); err != nil {
 		return fmt.Errorf("os.MkdirAll: %w", err)
 	}
@@ -97,38 +140,38 @@ func saveAs(certPath string) error {
 	}
 	defer fi.Close()
 
-	data, err := x509.MarshalPKCS8PrivateKey(caKey)
+	data, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
 		return fmt.Errorf("x509.MarshalPKCS8PrivateKey: %w", err)
 	}
 
 	if err = pem.Encode(fi, &pem.Block{Type: "PRIVATE KEY", Bytes: data}); err != nil {
-		return fmt.Errorf("caKey pem.Encode: %w", err)
+		return fmt.Errorf("key pem.Encode: %w", err)
 	}
-	if err = pem.Encode(fi, &pem.Block{Type: "CERTIFICATE", Bytes: caCer.Raw}); err != nil {
-		return fmt.Errorf("caCer pem.Encode: %w", err)
+	if err = pem.Encode(fi, &pem.Block{Type: "CERTIFICATE", Bytes: cer.Raw}); err != nil {
+		return fmt.Errorf("cer pem.Encode: %w", err)
 	}
 	return nil
 }
 
 // https://cs.opensource.google/go/go/+/refs/tags/go1.24.3:src/crypto/tls/generate_cert.go
 // https://github.com/mitmproxy/mitmproxy/blob/d4200a7c0d2f4efd77c44651645b59662a29a54a/mitmproxy/certs.py#L176
-func generateRoot() (err error) {
-	caKey, err = rsa.GenerateKey(rand.Reader, 2048)
+func generateRoot(commonName string) (*x509.Certificate, crypto.Signer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return fmt.Errorf("rsa.GenerateKey: %w", err)
+		return nil, nil, fmt.Errorf("rsa.GenerateKey: %w", err)
 	}
 
 	serialNumber, err := generateSerialNumber()
 	if err != nil {
-		return fmt.Errorf("ca.generateSerialNumber: %w", err)
+		return nil, nil, fmt.Errorf("ca.generateSerialNumber: %w", err)
 	}
 
 	now := time.Now()
 	tmpl := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			CommonName:   "mitmproxy",
+			CommonName:   commonName,
 			Organization: []string{"mitmproxy"},
 		},
 		NotBefore:             now.Add(-48 * time.Hour),
@@ -141,15 +184,17 @@ func generateRoot() (err error) {
 	}
 
 	// If parent is equal to template then the certificate is self-signed.
-	if caCer, err = generateCert(&tmpl, &tmpl, caKey.Public(), caKey); err != nil {
-		return fmt.Errorf("ca.generateCert: %w", err)
+	if cer, err := generateCert(&tmpl, &tmpl, key.Public(), key); err != nil {
+		return nil, nil, fmt.Errorf("ca.generateCert: %w", err)
+	} else {
+		return cer, key, nil
 	}
-	return nil
 }
 
 // An end-entity certificate is sometimes called a leaf certificate.
 // Set Subject.CommonName from first Subject Alternate Name(DNSNames and IPAddresses).
-func generateLeaf(dns []string, ips []net.IP) (*x509.Certificate, crypto.Signer, error) {
+// Each leaf certificate gets its own key pair from leafKeys, and rootKey is only used for signing.
+func generateLeaf(root *x509.Certificate, rootKey crypto.Signer, dns []string, ips []net.IP) (*x509.Certificate, crypto.Signer, error) {
 	if len(dns) == 0 && len(ips) == 0 {
 		return nil, nil, errors.New("ca: missing Subject Alternate Name for leaf certificate")
 	}
@@ -167,61 +212,208 @@ func generateLeaf(dns []string, ips []net.IP) (*x509.Certificate, crypto.Signer,
 			Organization: []string{"mitmproxy"},
 		},
 		NotBefore:          now.Add(-48 * time.Hour),
-		NotAfter:           now.Add(24 * time.Hour * 365),
+		NotAfter:           minTime(now.Add(24*time.Hour*365), root.NotAfter),
 		DNSNames:           dns,
 		IPAddresses:        ips,
 		SignatureAlgorithm: x509.SHA256WithRSA,
 		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 	}
 
-	// https://github.com/mitmproxy/mitmproxy/blob/d4200a7c0d2f4efd77c44651645b59662a29a54a/mitmproxy/certs.py#L281
-	if cer, err := generateCert(&tmpl, caCer, caKey.Public(), caKey); err != nil {
+	return signLeaf(&tmpl, root, rootKey)
+}
+
+// generateMirrorLeaf copies Subject.CommonName, Subject Alternate Name and validity from upstream certificate.
+// If upstream certificate has no Subject Alternate Name, fallback names in dns and ips will be used.
+// https://docs.mitmproxy.org/stable/concepts-howmitmproxyworks/#complication-1-whats-the-remote-hostname
+func generateMirrorLeaf(root *x509.Certificate, rootKey crypto.Signer, upstream *x509.Certificate, dns []string, ips []net.IP) (*x509.Certificate, crypto.Signer, error) {
+	if len(upstream.DNSNames) > 0 || len(upstream.IPAddresses) > 0 {
+		dns, ips = upstream.DNSNames, upstream.IPAddresses
+	}
+	if len(dns) == 0 && len(ips) == 0 {
+		return nil, nil, errors.New("ca: missing Subject Alternate Name for leaf certificate")
+	}
+
+	serialNumber, err := generateSerialNumber()
+	if err != nil {
+		return nil, nil, fmt.Errorf("ca.generateSerialNumber: %w", err)
+	}
+
+	commonName := upstream.Subject.CommonName
+	if commonName == "" || len(commonName) > 64 {
+		commonName = pickCommonName(dns, ips)
+	}
+	now := time.Now()
+	tmpl := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"mitmproxy"},
+		},
+		NotBefore:          maxTime(upstream.NotBefore, now.Add(-48*time.Hour)),
+		NotAfter:           minTime(minTime(upstream.NotAfter, now.Add(24*time.Hour*365)), root.NotAfter),
+		DNSNames:           dns,
+		IPAddresses:        ips,
+		SignatureAlgorithm: x509.SHA256WithRSA,
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return signLeaf(&tmpl, root, rootKey)
+}
+
+func signLeaf(tmpl *x509.Certificate, root *x509.Certificate, rootKey crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
+	key, err := leafKeys.Get()
+	if err != nil {
+		return nil, nil, fmt.Errorf("leafKeys.Get: %w", err)
+	}
+	if cer, err := generateCert(tmpl, root, key.Public(), rootKey); err != nil {
 		return nil, nil, fmt.Errorf("ca.generateCert: %w", err)
 	} else {
-		return cer, caKey, nil
+		return cer, key, nil
 	}
 }
 
+func splitServerName(serverName string) (dns []string, ips []net.IP) {
+	if ip := net.ParseIP(serverName); ip != nil {
+		return nil, []net.IP{ip}
+	}
+	return asteriskFor(serverName), nil
+}
+
 func GetCertificate(ctx context.Context, serverName string) (*tls.Certificate, error) {
-	var dns []string
-	var ips []net.IP
-	ip := net.ParseIP(serverName)
-	if ip != nil {
-		ips = []net.IP{ip}
-	} else {
-		dns = asteriskFor(serverName)
+	dns, ips := splitServerName(serverName)
+	if len(dns) > 0 {
 		serverName = dns[0]
 	}
+	return loadOrIssue(ctx, serverName, func(root *x509.Certificate, rootKey crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
+		return generateLeaf(root, rootKey, dns, ips)
+	})
+}
 
-	if cer, ok := tlsCerCache.Load(serverName); ok {
+// GetMirrorCertificate issues leaf certificate that mirrors the upstream certificate, and caches it by upstream fingerprint.
+// The serverName is used as Subject Alternate Name only if upstream certificate has none.
+func GetMirrorCertificate(ctx context.Context, upstream *x509.Certificate, serverName string) (*tls.Certificate, error) {
+	sum := sha256.Sum256(upstream.Raw)
+	dns, ips := splitServerName(serverName)
+	return loadOrIssue(ctx, "mirror:"+hex.EncodeToString(sum[:]), func(root *x509.Certificate, rootKey crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
+		return generateMirrorLeaf(root, rootKey, upstream, dns, ips)
+	})
+}
+
+// GetUntrustedCertificate issues leaf certificate from an ephemeral root that no client trusts.
+// It is used to pass upstream certificate errors to clients instead of hiding them.
+func GetUntrustedCertificate(ctx context.Context, serverName string) (*tls.Certificate, error) {
+	untrustedOnce.Do(func() {
+		untrustedCer, untrustedKey, untrustedErr = generateRoot("glp untrusted upstream")
+	})
+	if untrustedErr != nil {
+		return nil, fmt.Errorf("ca.generateRoot: %w", untrustedErr)
+	}
+
+	dns, ips := splitServerName(serverName)
+	if len(dns) > 0 {
+		serverName = dns[0]
+	}
+	cer, _, err := tlsCerCache.LoadOrCreate("untrusted:"+serverName, func() (*tls.Certificate, error) {
+		cer, key, err := generateLeaf(untrustedCer, untrustedKey, dns, ips)
+		if err != nil {
+			return nil, err
+		}
 		global.LOG.Debug(ctx, "",
 			global.LogAttrTag("CERT"),
-			global.LogAttrMethod("LOAD"),
-			slog.String("name", serverName),
+			global.LogAttrMethod("STORE"),
+			slog.String("name", "untrusted:"+serverName),
 		)
-		return cer, nil
-	}
-	if cer, _, err := generateLeaf(dns, ips); err == nil {
+		return &tls.Certificate{
+			Certificate: [][]byte{cer.Raw, untrustedCer.Raw},
+			PrivateKey:  key,
+			Leaf:        cer,
+		}, nil
+	})
+	return cer, err
+}
+
+func loadOrIssue(ctx context.Context, name string, generate func(root *x509.Certificate, rootKey crypto.Signer) (*x509.Certificate, crypto.Signer, error)) (*tls.Certificate, error) {
+	cer, loaded, err := tlsCerCache.LoadOrCreate(name, func() (*tls.Certificate, error) {
+		if tlsCerStore != nil {
+			if cer, ok := tlsCerStore.Load(name); ok {
+				global.LOG.Debug(ctx, "",
+					global.LogAttrTag("CERT"),
+					global.LogAttrMethod("LOAD"),
+					slog.String("name", name),
+					slog.String("from", "store"),
+				)
+				return cer, nil
+			}
+		}
+
+		root, rootKey := currentRoot()
+		cer, key, err := generate(root, rootKey)
+		if err != nil {
+			return nil, err
+		}
 		global.LOG.Debug(ctx, "",
 			global.LogAttrTag("CERT"),
 			global.LogAttrMethod("STORE"),
-			slog.String("name", serverName),
+			slog.String("name", name),
 		)
 		tlsCer := &tls.Certificate{
-			Certificate: [][]byte{cer.Raw, caCer.Raw},
-			PrivateKey:  caKey,
+			Certificate: [][]byte{cer.Raw, root.Raw},
+			PrivateKey:  key,
 			Leaf:        cer,
 		}
-		tlsCerCache.LoadOrStore(serverName, tlsCer)
+		if tlsCerStore != nil {
+			if err := tlsCerStore.Save(name, tlsCer); err != nil {
+				global.LOG.Warn(ctx, "tlsCerStore.Save", logger.Error(err))
+			}
+		}
 		return tlsCer, nil
-	} else {
-		return nil, fmt.Errorf("ca.generateLeaf: %w", err)
+	})
+	if loaded && err == nil {
+		global.LOG.Debug(ctx, "",
+			global.LogAttrTag("CERT"),
+			global.LogAttrMethod("LOAD"),
+			slog.String("name", name),
+		)
 	}
+	return cer, err
 }
 
-func CacheStatus() (length int, capacity int) {
+func CacheStatus() CacheStats {
 	if tlsCerCache == nil {
+		return CacheStats{}
+	}
+	return tlsCerCache.Stats()
+}
+
+func StoreStatus() (length int, capacity int) {
+	if tlsCerStore == nil {
 		return 0, 0
 	}
-	return tlsCerCache.Status()
+	return tlsCerStore.Status()
+}
+
+func CertificatePEM() []byte {
+	root, _ := currentRoot()
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+}
+
+func CertificateDER() []byte {
+	root, _ := currentRoot()
+	return root.Raw
+}
+
+func CertificatePKCS12() ([]byte, error) {
+	root, _ := currentRoot()
+	return encodeTrustStore(root.Raw, root.Subject.CommonName)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of ca certificate in openssl format.
+func Fingerprint() string {
+	root, _ := currentRoot()
+	sum := sha256.Sum256(root.Raw)
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	result := make([]string, len(sum))
+	for i := range result {
+		result[i] = hexSum[2*i : 2*i+2]
+	}
+	return strings.Join(result, ":")
 }
@@ -2,15 +2,38 @@ package ca
 
 import (
 	"crypto/tls"
+	"errors"
 	"sync"
+	"time"
 )
 
 // https://github.com/golang/groupcache/blob/master/lru/lru.go
+// https://github.com/golang/groupcache/blob/master/singleflight/singleflight.go
 type Cache struct {
-	cap  int
-	root elem
-	idx  map[string]*elem
-	mu   *sync.Mutex
+	cap     int
+	renew   time.Duration
+	root    elem
+	idx     map[string]*elem
+	flights map[string]*flight
+	stats   CacheStats
+	mu      *sync.Mutex
+}
+
+type CacheStats struct {
+	Len       int
+	Cap       int
+	Hits      uint64 // found in cache
+	Misses    uint64 // not found in cache and started a new creation
+	Shared    uint64 // not found in cache but waited for an in-flight creation
+	Evictions uint64
+	Renewals  uint64 // found in cache but about to expire
+	InFlight  int
+}
+
+type flight struct {
+	wg   sync.WaitGroup
+	cert *tls.Certificate
+	err  error
 }
 
 type elem struct {
@@ -20,12 +43,16 @@ type elem struct {
 	cert *tls.Certificate
 }
 
-func NewCache(cap int) *Cache {
+// NewCache creates a lru cache with capacity cap.
+// Certificates that expire within renew duration are treated as missing, and will be created again.
+func NewCache(cap int, renew time.Duration) *Cache {
 	c := &Cache{
-		cap:  cap,
-		root: elem{},
-		idx:  make(map[string]*elem),
-		mu:   &sync.Mutex{},
+		cap:     cap,
+		renew:   renew,
+		root:    elem{},
+		idx:     make(map[string]*elem),
+		flights: make(map[string]*flight),
+		mu:      &sync.Mutex{},
 	}
 	c.root.next = &c.root
 	c.root.prev = &c.root
@@ -37,6 +64,10 @@ func (c *Cache) Load(key string) (value *tls.Certificate, ok bool) {
 	defer c.mu.Unlock()
 
 	if e, ok := c.idx[key]; ok {
+		if c.expired(e) {
+			c.remove(e)
+			return nil, false
+		}
 		c.moveToFront(e)
 		return e.cert, true
 	}
@@ -50,22 +81,89 @@ func (c *Cache) LoadOrStore(key string, value *tls.Certificate) (actual *tls.Cer
 	if e, ok := c.idx[key]; ok {
 		c.moveToFront(e)
 		return e.cert, true
-	} else {
-		e = c.pushFront(&elem{name: key, cert: value})
-		if len(c.idx) > c.cap {
-			if ee := c.back(); ee != nil {
-				c.remove(ee)
-			}
+	}
+	return c.storeLocked(key, value), false
+}
+
+// LoadOrCreate returns the existing value for the key if present.
+// Otherwise, it calls create and stores the result if no error occurs.
+// Concurrent callers for the same key will wait for the in-flight creation and share its result.
+func (c *Cache) LoadOrCreate(key string, create func() (*tls.Certificate, error)) (value *tls.Certificate, loaded bool, err error) {
+	c.mu.Lock()
+	if e, ok := c.idx[key]; ok && !c.expired(e) {
+		c.moveToFront(e)
+		c.stats.Hits++
+		c.mu.Unlock()
+		return e.cert, true, nil
+	} else if ok {
+		c.remove(e)
+		c.stats.Renewals++
+	}
+	if f, ok := c.flights[key]; ok {
+		c.stats.Shared++
+		c.mu.Unlock()
+		f.wg.Wait()
+		return f.cert, true, f.err
+	}
+	c.stats.Misses++
+	f := &flight{}
+	f.wg.Add(1)
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		if f.err == nil && f.cert != nil {
+			c.storeLocked(key, f.cert)
 		}
-		return e.cert, false
+		c.mu.Unlock()
+		f.wg.Done()
+	}()
+	f.err = errors.New("ca: panic in cache creation") // will be overwritten if create returns normally
+	f.cert, f.err = create()
+	return f.cert, false, f.err
+}
+
+// Purge removes all certificates in cache, e.g. after grace period of previous ca certificate.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for e := c.back(); e != nil; e = c.back() {
+		c.remove(e)
 	}
 }
 
-func (c *Cache) Status() (length int, capacity int) {
+func (c *Cache) Stats() CacheStats {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	return len(c.idx), c.cap
+	stats := c.stats
+	stats.Len = len(c.idx)
+	stats.Cap = c.cap
+	stats.InFlight = len(c.flights)
+	return stats
+}
+
+func (c *Cache) storeLocked(key string, value *tls.Certificate) *tls.Certificate {
+	if e, ok := c.idx[key]; ok {
+		c.moveToFront(e)
+		e.cert = value
+		return value
+	}
+	e := c.pushFront(&elem{name: key, cert: value})
+	if len(c.idx) > c.cap {
+		if ee := c.back(); ee != nil {
+			c.remove(ee)
+			c.stats.Evictions++
+		}
+	}
+	return e.cert
+}
+
+func (c *Cache) expired(e *elem) bool {
+	return e.cert.Leaf != nil && needRenewal(e.cert.Leaf, c.renew)
 }
 
 func (c *Cache) back() *elem {
@@ -39,10 +39,12 @@ func parsePrivateKey(der []byte) (crypto.Signer, error) {
 	return nil, errors.New("ca: failed to parse private key")
 }
 
+var errCertExpired = errors.New("ca: certificate has expired")
+
 // https://cs.opensource.google/go/go/+/refs/tags/go1.24.3:src/crypto/tls/tls.go;l=320
 func verify(cer *x509.Certificate, key crypto.Signer) error {
 	if time.Now().After(cer.NotAfter) {
-		return errors.New("ca: certificate has expired")
+		return errCertExpired
 	}
 
 	switch pub := cer.PublicKey.(type) {
@@ -92,6 +94,25 @@ func pickCommonName(dns []string, ips []net.IP) string {
 	return result[strings.IndexByte(result, '.')+1:]
 }
 
+// needRenewal reports whether certificate expires within the renewBefore duration.
+func needRenewal(cer *x509.Certificate, renewBefore time.Duration) bool {
+	return time.Now().Add(renewBefore).After(cer.NotAfter)
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
 func generateCert(template *x509.Certificate, parent *x509.Certificate, pub crypto.PublicKey, priv crypto.Signer) (*x509.Certificate, error) {
 	derBytes, err := x509.CreateCertificate(rand.Reader, template, parent, pub, priv)
 	if err != nil {
@@ -0,0 +1,77 @@
+package ca
+
+import (
+	"bytes"
+	"text/template"
+)
+
+const (
+	DistroAuto   = "auto"
+	DistroAlpine = "alpine"
+	DistroDebian = "debian"
+	DistroRHEL   = "rhel"
+)
+
+// https://wiki.alpinelinux.org/wiki/Setting_up_a_CA_certificate
+// https://manpages.debian.org/bookworm/ca-certificates/update-ca-certificates.8.en.html
+// https://www.redhat.com/en/blog/configure-ca-trust-list
+var installTemplate = template.Must(template.New("install.sh").Parse(`#!/bin/sh
+# install ca certificate of glp into system trust store
+# sha256 fingerprint: {{.Fingerprint}}
+set -e
+
+DISTRO='{{.Distro}}'
+if [ "$DISTRO" = 'auto' ]; then
+  if [ -f /etc/alpine-release ]; then
+    DISTRO=alpine
+  elif [ -f /etc/debian_version ]; then
+    DISTRO=debian
+  elif [ -f /etc/redhat-release ] || [ -d /etc/pki/ca-trust ]; then
+    DISTRO=rhel
+  else
+    echo 'glp: unsupported distribution, try with ?distro=alpine|debian|rhel' >&2
+    exit 1
+  fi
+fi
+
+CERT='{{.PEM}}'
+
+case "$DISTRO" in
+  alpine)
+    if command -v update-ca-certificates > /dev/null; then
+      mkdir -p /usr/local/share/ca-certificates
+      echo "$CERT" > /usr/local/share/ca-certificates/glp.crt
+      update-ca-certificates
+    else
+      echo "$CERT" >> /etc/ssl/certs/ca-certificates.crt
+    fi
+    ;;
+  debian)
+    mkdir -p /usr/local/share/ca-certificates
+    echo "$CERT" > /usr/local/share/ca-certificates/glp.crt
+    update-ca-certificates
+    ;;
+  rhel)
+    mkdir -p /etc/pki/ca-trust/source/anchors
+    echo "$CERT" > /etc/pki/ca-trust/source/anchors/glp.pem
+    update-ca-trust extract
+    ;;
+  *)
+    echo "glp: unknown distribution $DISTRO" >&2
+    exit 1
+    ;;
+esac
+echo "glp: ca certificate installed for $DISTRO"
+`))
+
+// InstallScript generates a shell script to install ca certificate into trust store of specified distro.
+// The distro will be detected by script itself if distro is DistroAuto.
+func InstallScript(distro string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := installTemplate.Execute(buf, struct {
+		Distro      string
+		Fingerprint string
+		PEM         string
+	}{distro, Fingerprint(), string(bytes.TrimSpace(CertificatePEM()))})
+	return buf.Bytes(), err
+}
@@ -0,0 +1,73 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+)
+
+const (
+	KeyAlgECDSA   = "ecdsa"
+	KeyAlgRSA2048 = "rsa2048"
+	KeyAlgRSA3072 = "rsa3072"
+	KeyAlgEd25519 = "ed25519"
+)
+
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case KeyAlgECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyAlgRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyAlgRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyAlgEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, errors.New("ca: unknown key algorithm: " + alg)
+	}
+}
+
+// KeyPool keeps a few pre-generated private keys in background,
+// so slow rsa key generation will not block the first tls handshake of each host.
+type KeyPool struct {
+	alg  string
+	keys chan crypto.Signer
+}
+
+func NewKeyPool(alg string, size int) (*KeyPool, error) {
+	if _, err := generateKey(alg); err != nil {
+		return nil, err
+	}
+	p := &KeyPool{
+		alg:  alg,
+		keys: make(chan crypto.Signer, size),
+	}
+	go p.fill()
+	return p, nil
+}
+
+func (p *KeyPool) fill() {
+	for {
+		key, err := generateKey(p.alg)
+		if err != nil {
+			return // alg has been checked in NewKeyPool, so err here is unexpected
+		}
+		p.keys <- key
+	}
+}
+
+// Get returns a pre-generated key if available, otherwise generates a new one synchronously.
+func (p *KeyPool) Get() (crypto.Signer, error) {
+	select {
+	case key := <-p.keys:
+		return key, nil
+	default:
+		return generateKey(p.alg)
+	}
+}
@@ -0,0 +1,162 @@
+package ca
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"unicode/utf16"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc7292
+// https://github.com/golang/crypto/blob/master/pkcs12/pkcs12.go
+var (
+	oidDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidSHA1            = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue // [0] EXPLICIT ANY DEFINED BY contentType
+}
+
+type safeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue     // [0] EXPLICIT ANY DEFINED BY bagId
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	Id    asn1.ObjectIdentifier
+	Value asn1.RawValue // SET OF ANY DEFINED BY attrId
+}
+
+type certBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+// encodeTrustStore encodes certificate into a PKCS#12 trust store without private key.
+// The store is protected by an empty password with SHA-1 MAC, which is accepted by most importers.
+func encodeTrustStore(der []byte, friendlyName string) ([]byte, error) {
+	bagData, err := asn1.Marshal(certBag{Id: oidCertTypeX509, Data: der})
+	if err != nil {
+		return nil, fmt.Errorf("asn1.Marshal certBag: %w", err)
+	}
+	nameData, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpString(friendlyName)})
+	if err != nil {
+		return nil, fmt.Errorf("asn1.Marshal friendlyName: %w", err)
+	}
+	safeContents, err := asn1.Marshal([]safeBag{{
+		Id:         oidCertBag,
+		Value:      explicitTag0(bagData),
+		Attributes: []pkcs12Attribute{{Id: oidFriendlyName, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: nameData}}},
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("asn1.Marshal safeContents: %w", err)
+	}
+	authSafe, err := asn1.Marshal([]contentInfo{dataContentInfo(safeContents)})
+	if err != nil {
+		return nil, fmt.Errorf("asn1.Marshal authSafe: %w", err)
+	}
+
+	salt := make([]byte, 8)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("rand.Read: %w", err)
+	}
+	const iterations = 2048
+	mac := hmac.New(sha1.New, pbkdfSHA1(salt, bmpPassword(""), iterations))
+	mac.Write(authSafe)
+
+	return asn1.Marshal(pfxPdu{
+		Version:  3,
+		AuthSafe: dataContentInfo(authSafe),
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    salt,
+			Iterations: iterations,
+		},
+	})
+}
+
+func dataContentInfo(data []byte) contentInfo {
+	octets, _ := asn1.Marshal(data) // marshal []byte as OCTET STRING never fails
+	return contentInfo{ContentType: oidDataContentType, Content: explicitTag0(octets)}
+}
+
+// RawValue with FullBytes ignores struct tags in asn1.Marshal, so explicit tagging is done manually.
+func explicitTag0(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// bmpString encodes s as BMPString without terminator for attributes like friendlyName.
+func bmpString(s string) []byte {
+	result := make([]byte, 0, 2*len(s))
+	for _, c := range utf16.Encode([]rune(s)) {
+		result = append(result, byte(c>>8), byte(c))
+	}
+	return result
+}
+
+// bmpPassword encodes password as BMPString with two zero bytes terminator.
+// https://datatracker.ietf.org/doc/html/rfc7292#appendix-B.1
+func bmpPassword(s string) []byte {
+	return append(bmpString(s), 0, 0)
+}
+
+// pbkdfSHA1 derives the MAC key with ID=3 from https://datatracker.ietf.org/doc/html/rfc7292#appendix-B.2
+// The key length equals to SHA-1 output size, so only the first block A_1 is required.
+func pbkdfSHA1(salt, password []byte, iterations int) []byte {
+	const u, v = sha1.Size, sha1.BlockSize
+	fill := func(src []byte) []byte {
+		if len(src) == 0 {
+			return nil
+		}
+		dst := make([]byte, v*((len(src)+v-1)/v))
+		for i := range dst {
+			dst[i] = src[i%len(src)]
+		}
+		return dst
+	}
+
+	D := make([]byte, v)
+	for i := range D {
+		D[i] = 3
+	}
+	I := append(fill(salt), fill(password)...)
+
+	h := sha1.New()
+	h.Write(D)
+	h.Write(I)
+	A := h.Sum(nil)
+	for i := 1; i < iterations; i++ {
+		sum := sha1.Sum(A)
+		A = sum[:]
+	}
+	return A[:u]
+}
@@ -0,0 +1,132 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// decodeTrustStore verifies MAC of PKCS#12 data with empty password, and returns the certificate and friendlyName of the only bag.
+func decodeTrustStore(t *testing.T, data []byte) (der []byte, friendlyName string) {
+	t.Helper()
+	var pfx pfxPdu
+	if rest, err := asn1.Unmarshal(data, &pfx); err != nil || len(rest) > 0 {
+		t.Fatalf("asn1.Unmarshal pfx: %v, %d trailing bytes", err, len(rest))
+	} else if pfx.Version != 3 || !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		t.Fatalf("pfx version = %d, content type = %v", pfx.Version, pfx.AuthSafe.ContentType)
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		t.Fatalf("asn1.Unmarshal authSafe: %v", err)
+	}
+	mac := hmac.New(sha1.New, pbkdfSHA1(pfx.MacData.MacSalt, bmpPassword(""), pfx.MacData.Iterations))
+	mac.Write(authSafe)
+	if !pfx.MacData.Mac.Algorithm.Algorithm.Equal(oidSHA1) || !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		t.Fatal("MAC verification failed")
+	}
+
+	var contents []contentInfo
+	if _, err := asn1.Unmarshal(authSafe, &contents); err != nil || len(contents) != 1 {
+		t.Fatalf("asn1.Unmarshal contentInfo: %v, %d items", err, len(contents))
+	}
+	var safeContents []byte
+	if _, err := asn1.Unmarshal(contents[0].Content.Bytes, &safeContents); err != nil {
+		t.Fatalf("asn1.Unmarshal safeContents: %v", err)
+	}
+	var bags []safeBag
+	if _, err := asn1.Unmarshal(safeContents, &bags); err != nil || len(bags) != 1 || !bags[0].Id.Equal(oidCertBag) {
+		t.Fatalf("asn1.Unmarshal safeBag: %v, %d bags", err, len(bags))
+	}
+	var cert certBag
+	if _, err := asn1.Unmarshal(bags[0].Value.Bytes, &cert); err != nil || !cert.Id.Equal(oidCertTypeX509) {
+		t.Fatalf("asn1.Unmarshal certBag: %v, type %v", err, cert.Id)
+	}
+	if len(bags[0].Attributes) != 1 || !bags[0].Attributes[0].Id.Equal(oidFriendlyName) {
+		t.Fatalf("bag attributes = %v, want friendlyName only", bags[0].Attributes)
+	}
+	var name asn1.RawValue
+	if _, err := asn1.Unmarshal(bags[0].Attributes[0].Value.Bytes, &name); err != nil || name.Tag != asn1.TagBMPString || len(name.Bytes)%2 != 0 {
+		t.Fatalf("asn1.Unmarshal friendlyName: %v, tag %d", err, name.Tag)
+	}
+	units := make([]uint16, len(name.Bytes)/2)
+	for i := range units {
+		units[i] = uint16(name.Bytes[2*i])<<8 | uint16(name.Bytes[2*i+1])
+	}
+	return cert.Data, string(utf16.Decode(units))
+}
+
+func TestEncodeTrustStore(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "glp test root"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"glp test root", "", "根证书 \U0001F600"} {
+		data, err := encodeTrustStore(der, name)
+		if err != nil {
+			t.Fatalf("encodeTrustStore(%q): %v", name, err)
+		}
+		gotDER, gotName := decodeTrustStore(t, data)
+		if !bytes.Equal(gotDER, der) {
+			t.Errorf("certificate in trust store of %q differs", name)
+		}
+		if gotName != name { // friendlyName has no NUL terminator, unlike password
+			t.Errorf("friendlyName = %q, want %q", gotName, name)
+		}
+	}
+}
+
+// Test vector from https://github.com/golang/crypto/blob/master/pkcs12/mac_test.go
+func TestPBKDFSHA1(t *testing.T) {
+	salt := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	mac := hmac.New(sha1.New, pbkdfSHA1(salt, bmpPassword("Sesame open"), 2048))
+	mac.Write([]byte{11, 12, 13, 14, 15})
+	if got, want := hex.EncodeToString(mac.Sum(nil)), "18203dff1e16f492f2afc891a9bad6ca9dee5193"; got != want {
+		t.Errorf("MAC = %s, want %s", got, want)
+	}
+}
+
+// https://datatracker.ietf.org/doc/html/rfc7292#appendix-B.1
+func TestBMPString(t *testing.T) {
+	tests := []struct {
+		input    string
+		str      string
+		password string
+	}{
+		{"", "", "0000"},
+		{"glp", "0067006c0070", "0067006c00700000"},
+		{"根", "6839", "68390000"},
+		{"\U0001F600", "d83dde00", "d83dde000000"}, // surrogate pair
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(bmpString(tt.input)); got != tt.str {
+			t.Errorf("bmpString(%q) = %s, want %s", tt.input, got, tt.str)
+		}
+		if got := hex.EncodeToString(bmpPassword(tt.input)); got != tt.password {
+			t.Errorf("bmpPassword(%q) = %s, want %s", tt.input, got, tt.password)
+		}
+	}
+}
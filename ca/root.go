@@ -0,0 +1,159 @@
+package ca
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/whoisnian/glb/logger"
+	"github.com/whoisnian/glp/global"
+)
+
+var (
+	prevCer   *x509.Certificate // previous ca certificate before rollover, protected by caMu
+	prevUntil time.Time         // previous ca certificate is trusted until prevUntil
+)
+
+func currentRoot() (*x509.Certificate, crypto.Signer) {
+	caMu.RLock()
+	defer caMu.RUnlock()
+	return caCer, caKey
+}
+
+// trustedIssuer returns the current or previous (still in grace period) ca certificate that signed cer.
+func trustedIssuer(cer *x509.Certificate) (*x509.Certificate, error) {
+	caMu.RLock()
+	defer caMu.RUnlock()
+
+	err := cer.CheckSignatureFrom(caCer)
+	if err == nil {
+		return caCer, nil
+	}
+	if prevCer != nil && time.Now().Before(prevUntil) && cer.CheckSignatureFrom(prevCer) == nil {
+		return prevCer, nil
+	}
+	return nil, fmt.Errorf("cer.CheckSignatureFrom: %w", err)
+}
+
+// loadPrevious loads the previous ca certificate saved by rollover.
+// The modification time of file is regarded as the rollover time.
+func loadPrevious(certPath string) error {
+	info, err := os.Stat(certPath)
+	if err != nil {
+		return fmt.Errorf("os.Stat: %w", err)
+	}
+	until := info.ModTime().Add(global.CFG.CAGrace)
+	if time.Now().After(until) {
+		return os.Remove(certPath)
+	}
+
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return fmt.Errorf("os.ReadFile: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("ca: failed to parse pem block")
+	}
+	cer, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("x509.ParseCertificate: %w", err)
+	}
+
+	caMu.Lock()
+	defer caMu.Unlock()
+	prevCer, prevUntil = cer, minTime(until, cer.NotAfter)
+	return nil
+}
+
+// rollover generates a new ca certificate to replace the current one.
+// The current one is kept as previous ca certificate, and will be trusted for CAGrace duration:
+// leaves signed by it in cache or store are still served during grace period, and new leaves are signed by the new one.
+func rollover(ctx context.Context, certPath string) error {
+	cer, key, err := generateRoot("mitmproxy")
+	if err != nil {
+		return fmt.Errorf("ca.generateRoot: %w", err)
+	}
+
+	old, _ := currentRoot()
+	if old != nil && !time.Now().Before(old.NotAfter) {
+		old = nil // leaves signed by expired one are rejected by clients anyway
+	}
+	if old != nil {
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: old.Raw})
+		if err = os.WriteFile(certPath+".prev", data, 0600); err != nil {
+			return fmt.Errorf("os.WriteFile: %w", err)
+		}
+	}
+	if err = saveAs(certPath, cer, key); err != nil {
+		return fmt.Errorf("ca.saveAs: %w", err)
+	}
+
+	caMu.Lock()
+	if old != nil {
+		prevCer, prevUntil = old, minTime(time.Now().Add(global.CFG.CAGrace), old.NotAfter)
+	}
+	caCer, caKey = cer, key
+	caMu.Unlock()
+
+	global.LOG.Warnf(ctx, "ca certificate rolled over, new sha256 fingerprint: %s", Fingerprint())
+	return nil
+}
+
+// expirePrevious stops trusting the previous ca certificate after grace period.
+// Cache is purged, and leaves signed by previous one will be removed from store by readLeaf and re-issued.
+func expirePrevious(ctx context.Context, certPath string) {
+	caMu.Lock()
+	expired := prevCer != nil && !time.Now().Before(prevUntil)
+	if expired {
+		prevCer = nil
+	}
+	caMu.Unlock()
+	if !expired {
+		return
+	}
+
+	if tlsCerCache != nil {
+		tlsCerCache.Purge()
+	}
+	if err := os.Remove(certPath + ".prev"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		global.LOG.Warn(ctx, "os.Remove", logger.Error(err))
+	}
+	global.LOG.Warnf(ctx, "grace period of previous ca certificate ended, leaf certificates signed by it will be re-issued")
+}
+
+// checkRoot rolls over ca certificate if it has expired or will expire within CARollover, or warns within CAWarn.
+func checkRoot(ctx context.Context, certPath string) {
+	expirePrevious(ctx, certPath)
+	root, _ := currentRoot()
+	left := time.Until(root.NotAfter)
+	if left <= 0 {
+		global.LOG.Errorf(ctx, "ca certificate expired at %s, rolling over and clients must trust the new one", root.NotAfter.Format(time.RFC3339))
+	}
+	if left <= 0 || (global.CFG.CARollover > 0 && left < global.CFG.CARollover) {
+		if err := rollover(ctx, certPath); err != nil {
+			global.LOG.Error(ctx, "ca.rollover", logger.Error(err))
+		}
+	} else if left < global.CFG.CAWarn {
+		global.LOG.Warnf(ctx, "ca certificate will expire in %s at %s", left.Round(time.Hour), root.NotAfter.Format(time.RFC3339))
+	}
+}
+
+func watchRoot(ctx context.Context, certPath string) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkRoot(ctx, certPath)
+		}
+	}
+}
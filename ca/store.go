@@ -0,0 +1,205 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whoisnian/glb/util/osutil"
+	"github.com/whoisnian/glp/global"
+)
+
+// Store persists leaf certificates in a directory, so they can survive restarts.
+// Each certificate is saved as a single pem file with private key and certificate blocks,
+// and the cache key is kept in the 'Name' header of certificate block.
+// File name is the hex encoded sha256 digest of cache key, so different keys never share a file.
+type Store struct {
+	dir   string
+	cap   int
+	files map[string]time.Time // file name => modification time
+	mu    *sync.Mutex
+}
+
+func NewStore(dir string, cap int) (*Store, error) {
+	if err := os.MkdirAll(dir, osutil.DefaultDirMode); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	return &Store{
+		dir:   dir,
+		cap:   cap,
+		files: make(map[string]time.Time),
+		mu:    &sync.Mutex{},
+	}, nil
+}
+
+// LoadAll reads all valid certificates in store directory and calls fn for each of them from oldest to newest.
+// Expired certificates, certificates signed by a different ca and files not named after their key will be removed.
+func (s *Store) LoadAll(fn func(name string, cer *tls.Certificate)) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("os.ReadDir: %w", err)
+	}
+
+	type result struct {
+		name    string
+		cer     *tls.Certificate
+		modTime time.Time
+	}
+	var results []result
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		name, cer, err := readLeaf(filepath.Join(s.dir, entry.Name()))
+		if err != nil || storeFileName(name) != entry.Name() {
+			os.Remove(filepath.Join(s.dir, entry.Name()))
+			continue
+		}
+		results = append(results, result{name, cer, info.ModTime()})
+	}
+	slices.SortFunc(results, func(a, b result) int { return a.modTime.Compare(b.modTime) })
+
+	s.mu.Lock()
+	for _, r := range results {
+		s.files[storeFileName(r.name)] = r.modTime
+	}
+	s.evictLocked()
+	s.mu.Unlock()
+
+	for _, r := range results {
+		fn(r.name, r.cer)
+	}
+	return nil
+}
+
+func (s *Store) Load(name string) (*tls.Certificate, bool) {
+	fname := storeFileName(name)
+	s.mu.Lock()
+	_, ok := s.files[fname]
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	if stored, cer, err := readLeaf(filepath.Join(s.dir, fname)); err == nil && stored == name {
+		return cer, true
+	}
+	s.Remove(name)
+	return nil, false
+}
+
+func (s *Store) Save(name string, cer *tls.Certificate) error {
+	data, err := x509.MarshalPKCS8PrivateKey(cer.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("x509.MarshalPKCS8PrivateKey: %w", err)
+	}
+	buf := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data})
+	buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Headers: map[string]string{"Name": name}, Bytes: cer.Leaf.Raw})...)
+
+	fname := storeFileName(name)
+	if err = os.WriteFile(filepath.Join(s.dir, fname), buf, 0600); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[fname] = time.Now()
+	s.evictLocked()
+	return nil
+}
+
+func (s *Store) Remove(name string) {
+	fname := storeFileName(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, fname)
+	os.Remove(filepath.Join(s.dir, fname))
+}
+
+func (s *Store) Status() (length int, capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.files), s.cap
+}
+
+func (s *Store) evictLocked() {
+	for len(s.files) > s.cap {
+		var oldest string
+		var oldestTime time.Time
+		for fname, modTime := range s.files {
+			if oldest == "" || modTime.Before(oldestTime) {
+				oldest, oldestTime = fname, modTime
+			}
+		}
+		delete(s.files, oldest)
+		os.Remove(filepath.Join(s.dir, oldest))
+	}
+}
+
+func storeFileName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:]) + ".pem"
+}
+
+// readLeaf parses a pem file saved by Store, and checks whether it is still valid and signed by trusted ca.
+func readLeaf(fpath string) (string, *tls.Certificate, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return "", nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+
+	var name string
+	var block *pem.Block
+	var cer *x509.Certificate
+	var key crypto.Signer
+	for len(data) > 0 {
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if cer == nil && block.Type == "CERTIFICATE" {
+			if cer, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return "", nil, fmt.Errorf("x509.ParseCertificate: %w", err)
+			}
+			name = block.Headers["Name"]
+		} else if key == nil && strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			if key, err = parsePrivateKey(block.Bytes); err != nil {
+				return "", nil, fmt.Errorf("ca.parsePrivateKey: %w", err)
+			}
+		}
+	}
+	if cer == nil || key == nil || name == "" {
+		return "", nil, errors.New("ca: incomplete leaf certificate in store")
+	}
+
+	if err = verify(cer, key); err != nil {
+		return "", nil, err
+	}
+	if needRenewal(cer, global.CFG.LeafRenew) {
+		return "", nil, errors.New("ca: leaf certificate needs renewal")
+	}
+	issuer, err := trustedIssuer(cer)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, &tls.Certificate{
+		Certificate: [][]byte{cer.Raw, issuer.Raw},
+		PrivateKey:  key,
+		Leaf:        cer,
+	}, nil
+}
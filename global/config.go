@@ -2,6 +2,7 @@ package global
 
 import (
 	"context"
+	"time"
 
 	"github.com/whoisnian/glb/config"
 )
@@ -12,10 +13,43 @@ type Config struct {
 	Debug   bool `flag:"d,false,Enable debug output"`
 	Version bool `flag:"v,false,Show version and quit"`
 
-	ListenAddr string `flag:"l,127.0.0.1:8080,HTTP proxy server listen addr"`
-	CACertPath string `flag:"ca,~/.mitmproxy/mitmproxy-ca.pem,CA certificate to issue leaf certificates"`
-	RelayProxy string `flag:"proxy,,Relay to upstream proxy (socks5/http/https)"`
-	KeyLogFile string `flag:"keylog,,Key log file for TLS decryption in wireshark"`
+	ListenAddr  string        `flag:"l,127.0.0.1:8080,HTTP proxy server listen addr"`
+	IdleTimeout time.Duration `flag:"idle,90s,Idle timeout of keep-alive client connections"`
+	DialTimeout time.Duration `flag:"dialtimeout,30s,Timeout of connecting to upstream server including relay proxy handshake (0 to disable)"`
+	TLSTimeout  time.Duration `flag:"tlstimeout,10s,Timeout of TLS handshake with client or upstream server (0 to disable)"`
+	AuthFile    string        `flag:"auth,,File of user:hash entries for Basic or user:glp:ha1 entries for Digest to authenticate proxy clients"`
+	ProxyProto  string        `flag:"proxyproto,off,Accept PROXY protocol v1/v2 header from load balancer on listeners (off/optional/required)"`
+	SocksAddr   string        `flag:"socks,,SOCKS5 proxy server listen addr (empty to disable)"`
+	SocksAuth   string        `flag:"socksauth,,Username and password required from SOCKS5 clients in user:pass format"`
+	TProxyAddr  string        `flag:"transparent,,Transparent proxy listen addr for iptables REDIRECT or TPROXY on linux (empty to disable)"`
+	CACertPath  string        `flag:"ca,~/.mitmproxy/mitmproxy-ca.pem,CA certificate to issue leaf certificates"`
+	CAHostName  string        `flag:"cahost,glp.ca,Reserved hostname for clients to download CA certificate through proxy"`
+	CAWarn      time.Duration `flag:"cawarn,720h,Warn when CA certificate expires within this duration"`
+	CARollover  time.Duration `flag:"carollover,0,Roll over to a new CA certificate when it expires within this duration (0 to roll over only after expiry)"`
+	CAGrace     time.Duration `flag:"cagrace,168h,Keep serving leaf certificates signed by previous CA certificate for this duration after rollover"`
+	LeafKeyAlg  string        `flag:"key,ecdsa,Key algorithm of leaf certificates (ecdsa/rsa2048/rsa3072/ed25519)"`
+	CacheSize   int           `flag:"cachesize,128,Capacity of in-memory leaf certificate cache"`
+	CacheDir    string        `flag:"cachedir,,Directory to persist leaf certificates across restarts"`
+	StoreSize   int           `flag:"storesize,4096,Capacity of leaf certificates in cache directory"`
+	LeafRenew   time.Duration `flag:"leafrenew,24h,Renew leaf certificates when they expire within this duration"`
+	Passthrough string        `flag:"passthrough,,Comma separated host patterns or CIDRs to tunnel TLS without interception"`
+	LearnPeriod time.Duration `flag:"learn,0,Tunnel hosts without interception for this duration after clients reject intercepted certificate (0 to disable)"`
+	PoolPolicy  string        `flag:"pool,failover,Selection strategy of relay proxies separated by | in -proxy or -upstreams (failover/roundrobin/leastconn)"`
+	HealthCheck time.Duration `flag:"healthcheck,0,Interval of health checks through relay proxies in pools with more than one relay (0 to disable)"`
+	HealthAddr  string        `flag:"healthaddr,,Destination of CONNECT health checks through relay proxies (required if healthcheck is enabled)"`
+	EjectPeriod time.Duration `flag:"eject,30s,Skip relay proxy in pool for this duration after 3 consecutive dial errors (0 to disable)"`
+
+	UpstreamCert   bool   `flag:"upcert,false,Mirror names and validity of upstream server certificate in leaf certificates"`
+	UpstreamVerify bool   `flag:"upverify,false,Verify upstream certificate before interception and pass its errors to clients"`
+	UpstreamRoots  string `flag:"uproots,,Extra root certificates bundle to verify upstream servers"`
+	InsecureHosts  string `flag:"insecure,,Comma separated host patterns to skip upstream certificate verification"`
+	UpstreamPins   string `flag:"uppins,,Comma separated pattern=sha256/base64 SPKI pins of upstream servers"`
+	ClientCerts    string `flag:"clientcert,,Comma separated pattern=cert.pem[;key.pem] client certificates for upstream servers"`
+	HTTP1Only      bool   `flag:"http1,false,Disable HTTP/2 and keep both client and upstream connections on HTTP/1.1"`
+	RelayProxy     string `flag:"proxy,,Relay to upstream proxy (socks5/http/https) or pool of them separated by | or PAC file/url to choose upstream per destination"`
+	Upstreams      string `flag:"upstreams,,Comma separated name=url upstream proxies (socks5/http/https) for routing rules and url can be a pool like url1|url2"`
+	Routes         string `flag:"routes,,Comma separated pattern=name routing rules in order (pattern: .suffix/glob/CIDR/:port and name: upstream/direct/reject/default)"`
+	KeyLogFile     string `flag:"keylog,,Key log file for TLS decryption in wireshark"`
 }
 
 func SetupConfig(_ context.Context) {
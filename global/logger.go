@@ -33,7 +33,10 @@ func SetupLogger(_ context.Context) {
 	attrTagMap = map[string]slog.Attr{
 		"CERT": slog.String("tag", "CERT"),
 		"HTTP": slog.String("tag", "HTTP"),
+		"H2":   slog.String("tag", "H2  "),
 		"TCP":  slog.String("tag", "TCP "),
+		"TLS":  slog.String("tag", "TLS "),
+		"WS":   slog.String("tag", "WS  "),
 	}
 
 	generateMethodAttr := func(val string) slog.Attr {
@@ -90,6 +93,10 @@ func LogAttrURL(u *url.URL) slog.Attr {
 	}
 }
 
+func LogAttrClient(addr string) slog.Attr {
+	return slog.String("client", addr)
+}
+
 func LogAttrDuration(d time.Duration) slog.Attr {
 	if colorful {
 		return slog.Any("duration", logger.AnsiString{
@@ -3,8 +3,16 @@ module github.com/whoisnian/glp
 go 1.24.0
 
 require (
+	github.com/dop251/goja v0.0.0-20260106131823-651366fbe6e3
 	github.com/whoisnian/glb v1.5.6
+	golang.org/x/crypto v0.38.0
 	golang.org/x/net v0.40.0
 )
 
-require golang.org/x/sys v0.33.0 // indirect
+require (
+	github.com/dlclark/regexp2 v1.11.4 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/text v0.25.0 // indirect
+)
@@ -38,6 +38,26 @@ func main() {
 			global.LOG.Fatal(ctx, "server.ListenAndServe", logger.Error(err))
 		}
 	}()
+	if global.CFG.SocksAddr != "" {
+		go func() {
+			global.LOG.Infof(ctx, "socks5 server started: socks5://%s", global.CFG.SocksAddr)
+			if err := server.ListenAndServeSocks5(global.CFG.SocksAddr); errors.Is(err, proxy.ErrServerClosed) {
+				global.LOG.Warn(ctx, "socks5 server shutting down")
+			} else if err != nil {
+				global.LOG.Fatal(ctx, "server.ListenAndServeSocks5", logger.Error(err))
+			}
+		}()
+	}
+	if global.CFG.TProxyAddr != "" {
+		go func() {
+			global.LOG.Infof(ctx, "transparent proxy server started: %s", global.CFG.TProxyAddr)
+			if err := server.ListenAndServeTransparent(global.CFG.TProxyAddr); errors.Is(err, proxy.ErrServerClosed) {
+				global.LOG.Warn(ctx, "transparent proxy server shutting down")
+			} else if err != nil {
+				global.LOG.Fatal(ctx, "server.ListenAndServeTransparent", logger.Error(err))
+			}
+		}()
+	}
 
 	osutil.WaitForStop()
 
@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whoisnian/glb/util/fsutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	authRealm     = "glp"
+	authNonceTTL  = 5 * time.Minute
+	authCacheTTL  = 10 * time.Minute
+	authCacheSize = 1024
+)
+
+type userKey struct{}
+
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// userFrom returns the username authenticated by Proxy-Authorization, or empty string if auth is disabled.
+func userFrom(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// clientAddr returns remote address of req with authenticated username like 'user@127.0.0.1:12345' for logging.
+func clientAddr(req *http.Request) string {
+	if user := userFrom(req.Context()); user != "" {
+		return user + "@" + req.RemoteAddr
+	}
+	return req.RemoteAddr
+}
+
+// proxyAuth verifies Proxy-Authorization of client requests with users loaded from file.
+// Lines like 'user:hash' are htpasswd entries for Basic auth, where hash is bcrypt or '{SHA}' format,
+// and lines like 'user:realm:ha1' are htdigest entries for Digest auth, where realm should be 'glp'.
+type proxyAuth struct {
+	basic    map[string]string // user => hash
+	digest   map[string]string // user => hex(md5(user:realm:password))
+	nonceKey []byte
+	verified map[[sha256.Size]byte]verifiedUser // sha256(credentials) => user, to skip slow bcrypt for keep-alive clients
+	mu       sync.Mutex
+}
+
+type verifiedUser struct {
+	user  string
+	until time.Time
+}
+
+func newProxyAuth(file string) (*proxyAuth, error) {
+	fpath, err := fsutil.ExpandHomeDir(file)
+	if err != nil {
+		return nil, fmt.Errorf("fsutil.ExpandHomeDir: %w", err)
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+
+	a := &proxyAuth{
+		basic:    make(map[string]string),
+		digest:   make(map[string]string),
+		nonceKey: make([]byte, 32),
+		verified: make(map[[sha256.Size]byte]verifiedUser),
+	}
+	rand.Read(a.nonceKey)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) == 2 && (strings.HasPrefix(fields[1], "$2a$") || strings.HasPrefix(fields[1], "$2b$") || strings.HasPrefix(fields[1], "$2y$") || strings.HasPrefix(fields[1], "{SHA}")) {
+			a.basic[fields[0]] = fields[1]
+		} else if len(fields) == 3 && fields[1] == authRealm && len(fields[2]) == md5.Size*2 {
+			a.digest[fields[0]] = strings.ToLower(fields[2])
+		} else {
+			return nil, fmt.Errorf("proxy: unsupported auth entry at %s:%d", fpath, lineNum)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanner.Err: %w", err)
+	}
+	if len(a.basic)+len(a.digest) == 0 {
+		return nil, errors.New("proxy: no auth entry found in " + fpath)
+	}
+	return a, nil
+}
+
+// authenticate returns username if Proxy-Authorization of req is valid.
+// The stale result reports whether client should retry Digest auth with a new nonce.
+func (a *proxyAuth) authenticate(req *http.Request) (user string, stale bool, ok bool) {
+	scheme, credentials, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		user, ok = a.verifyBasic(credentials)
+		return user, false, ok
+	case "digest":
+		return a.verifyDigest(req, credentials)
+	}
+	return "", false, false
+}
+
+func (a *proxyAuth) verifyBasic(credentials string) (string, bool) {
+	sum := sha256.Sum256([]byte(credentials))
+	if user, ok := a.loadVerified(sum); ok {
+		return user, true
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", false
+	}
+	user, pass, _ := strings.Cut(string(raw), ":")
+	hash, ok := a.basic[user]
+	if !ok {
+		return "", false
+	}
+	var valid bool
+	if digest, isSHA := strings.CutPrefix(hash, "{SHA}"); isSHA {
+		expected := sha1.Sum([]byte(pass))
+		valid = subtle.ConstantTimeCompare([]byte(digest), []byte(base64.StdEncoding.EncodeToString(expected[:]))) == 1
+	} else {
+		valid = bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	}
+	if valid {
+		a.storeVerified(sum, user)
+	}
+	return user, valid
+}
+
+func (a *proxyAuth) loadVerified(sum [sha256.Size]byte) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	v, ok := a.verified[sum]
+	return v.user, ok && time.Now().Before(v.until)
+}
+
+// storeVerified caches verified credentials for authCacheTTL, and the cache is reset if it is full of unexpired entries.
+func (a *proxyAuth) storeVerified(sum [sha256.Size]byte, user string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if len(a.verified) >= authCacheSize {
+		for k, v := range a.verified {
+			if !now.Before(v.until) {
+				delete(a.verified, k)
+			}
+		}
+		if len(a.verified) >= authCacheSize {
+			clear(a.verified)
+		}
+	}
+	a.verified[sum] = verifiedUser{user: user, until: now.Add(authCacheTTL)}
+}
+
+// verifyDigest verifies Digest auth with MD5 algorithm, and nonce count is not tracked for replay.
+// The uri must be the request-target of req, so that a captured response cannot be replayed for other targets.
+// Origin-form of absolute request-target is also accepted for non-CONNECT requests, as sent by clients like curl.
+// https://www.rfc-editor.org/rfc/rfc7616#section-3.4.1
+func (a *proxyAuth) verifyDigest(req *http.Request, credentials string) (user string, stale bool, ok bool) {
+	params := parseAuthParams(credentials)
+	user = params["username"]
+	ha1, ok := a.digest[user]
+	if !ok || params["realm"] != authRealm || !matchDigestURI(params["uri"], req) {
+		return "", false, false
+	}
+	if alg := params["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return "", false, false
+	}
+	if valid, expired := a.checkNonce(params["nonce"]); !valid {
+		return "", false, false
+	} else if expired {
+		return "", true, false
+	}
+
+	ha2 := md5Hex(req.Method + ":" + params["uri"])
+	var expected string
+	if qop := params["qop"]; qop == "auth" {
+		expected = md5Hex(ha1 + ":" + params["nonce"] + ":" + params["nc"] + ":" + params["cnonce"] + ":" + qop + ":" + ha2)
+	} else if qop == "" {
+		expected = md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	} else {
+		return "", false, false
+	}
+	return user, false, subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) == 1
+}
+
+func matchDigestURI(uri string, req *http.Request) bool {
+	if uri == "" {
+		return false
+	} else if uri == req.RequestURI {
+		return true
+	}
+	return req.Method != http.MethodConnect && req.URL.IsAbs() && uri == req.URL.RequestURI()
+}
+
+// newNonce returns stateless nonce of timestamp and its hmac, so any nonce issued before can be verified without storage.
+func (a *proxyAuth) newNonce() string {
+	var buf [8 + sha256.Size]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(time.Now().Unix()))
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(buf[:8])
+	mac.Sum(buf[:8])
+	return base64.RawURLEncoding.EncodeToString(buf[:])
+}
+
+func (a *proxyAuth) checkNonce(nonce string) (valid bool, expired bool) {
+	buf, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(buf) != 8+sha256.Size {
+		return false, false
+	}
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(buf[:8])
+	if !hmac.Equal(mac.Sum(nil), buf[8:]) {
+		return false, false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(buf[:8])), 0)
+	return true, time.Since(issued) > authNonceTTL
+}
+
+// challenge returns header of 407 response that offers available auth schemes.
+func (a *proxyAuth) challenge(stale bool) http.Header {
+	header := http.Header{}
+	if len(a.digest) > 0 {
+		header.Add("Proxy-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s", stale=%t`, authRealm, a.newNonce(), stale))
+	}
+	if len(a.basic) > 0 {
+		header.Add("Proxy-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, authRealm))
+	}
+	return header
+}
+
+// parseAuthParams parses comma separated 'key=value' or 'key="quoted value"' pairs in Digest credentials.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, ", ") {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key, rest = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(rest)
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			s = rest[end:]
+		}
+		params[key] = value.String()
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestProxyAuth(t *testing.T, content string) (*proxyAuth, error) {
+	t.Helper()
+	fpath := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(fpath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return newProxyAuth(fpath)
+}
+
+// nonceAt returns nonce of proxyAuth issued at the given time.
+func nonceAt(a *proxyAuth, issued time.Time) string {
+	var buf [8 + sha256.Size]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(issued.Unix()))
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(buf[:8])
+	mac.Sum(buf[:8])
+	return base64.RawURLEncoding.EncodeToString(buf[:])
+}
+
+func TestNewProxyAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		basic   int
+		digest  int
+		fail    bool
+	}{
+		{"htpasswd sha", "# comment\n\nuser:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", 1, 0, false},
+		{"htdigest", "user:glp:b1d2d3a8a4e1b6e4a7e1a4a7d1d1d1d1\n", 0, 1, false},
+		{"plain password", "user:password\n", 0, 0, true},
+		{"htdigest of other realm", "user:other:b1d2d3a8a4e1b6e4a7e1a4a7d1d1d1d1\n", 0, 0, true},
+		{"no entry", "# comment only\n", 0, 0, true},
+	}
+	for _, tt := range tests {
+		a, err := newTestProxyAuth(t, tt.content)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: newProxyAuth succeeded, want error", tt.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: newProxyAuth: %v", tt.name, err)
+		} else if len(a.basic) != tt.basic || len(a.digest) != tt.digest {
+			t.Errorf("%s: newProxyAuth loaded %d basic and %d digest entries, want %d and %d", tt.name, len(a.basic), len(a.digest), tt.basic, tt.digest)
+		}
+	}
+}
+
+func TestProxyAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newTestProxyAuth(t, "bcrypt:"+string(hash)+"\n"+
+		"sha:{SHA}nU4eI71bcnBGqeO0t9tXvY1u5oQ=\n"+ // base64(sha1("pass"))
+		"digest:glp:"+md5Hex("digest:glp:pass")+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	basic := func(user, pass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+	nonce := a.newNonce()
+	digest := func(method, uri, nonce string, extra string) string {
+		ha1, ha2 := md5Hex("digest:glp:pass"), md5Hex(method+":"+uri)
+		response := md5Hex(ha1 + ":" + nonce + ":00000001:0a4f113b:auth:" + ha2)
+		return fmt.Sprintf(`Digest username="digest", realm="glp", nonce="%s", uri="%s", qop=auth, nc=00000001, cnonce="0a4f113b", response="%s"%s`, nonce, uri, response, extra)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		auth   string
+		user   string
+		stale  bool
+	}{
+		{"basic bcrypt", http.MethodConnect, "example.com:443", basic("bcrypt", "pass"), "bcrypt", false},
+		{"basic bcrypt cached", http.MethodConnect, "example.com:443", basic("bcrypt", "pass"), "bcrypt", false},
+		{"basic sha", http.MethodGet, "http://example.com/", basic("sha", "pass"), "sha", false},
+		{"basic wrong password", http.MethodGet, "http://example.com/", basic("bcrypt", "wrong"), "", false},
+		{"basic unknown user", http.MethodGet, "http://example.com/", basic("nobody", "pass"), "", false},
+		{"basic of digest user", http.MethodGet, "http://example.com/", basic("digest", "pass"), "", false},
+		{"digest connect", http.MethodConnect, "example.com:443", digest(http.MethodConnect, "example.com:443", nonce, ""), "digest", false},
+		{"digest absolute uri", http.MethodGet, "http://example.com/a?b=c", digest(http.MethodGet, "http://example.com/a?b=c", nonce, ""), "digest", false},
+		{"digest origin-form uri", http.MethodGet, "http://example.com/a?b=c", digest(http.MethodGet, "/a?b=c", nonce, ""), "digest", false},
+		{"digest uri of other target", http.MethodConnect, "example.com:443", digest(http.MethodConnect, "other.com:443", nonce, ""), "", false},
+		{"digest origin-form uri of other target", http.MethodGet, "http://example.com/a", digest(http.MethodGet, "/b", nonce, ""), "", false},
+		{"digest origin-form uri for connect", http.MethodConnect, "example.com:443", digest(http.MethodConnect, "/", nonce, ""), "", false},
+		{"digest method mismatch", http.MethodGet, "http://example.com/", digest(http.MethodPost, "http://example.com/", nonce, ""), "", false},
+		{"digest sha-256", http.MethodConnect, "example.com:443", digest(http.MethodConnect, "example.com:443", nonce, ", algorithm=SHA-256"), "", false},
+		{"digest forged nonce", http.MethodConnect, "example.com:443", digest(http.MethodConnect, "example.com:443", "AAAAAAAAAAA", ""), "", false},
+		{"digest stale nonce", http.MethodConnect, "example.com:443", digest(http.MethodConnect, "example.com:443", nonceAt(a, time.Now().Add(-2*authNonceTTL)), ""), "", true},
+		{"unknown scheme", http.MethodConnect, "example.com:443", "Bearer token", "", false},
+		{"missing", http.MethodConnect, "example.com:443", "", "", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.auth != "" {
+			req.Header.Set("Proxy-Authorization", tt.auth)
+		}
+		user, stale, ok := a.authenticate(req)
+		if ok != (tt.user != "") || (ok && user != tt.user) || stale != tt.stale {
+			t.Errorf("%s: authenticate() = %q, %t, %t, want %q, %t", tt.name, user, stale, ok, tt.user, tt.stale)
+		}
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	tests := []struct {
+		input string
+		want  map[string]string
+	}{
+		{`username="user", realm="glp", nc=00000001`, map[string]string{"username": "user", "realm": "glp", "nc": "00000001"}},
+		{`Username = "a, b" ,QOP=auth`, map[string]string{"username": "a, b", "qop": "auth"}},
+		{`uri="/a\"b\\c"`, map[string]string{"uri": `/a"b\c`}},
+		{`nonce="unterminated`, map[string]string{"nonce": "unterminated"}},
+		{`realm="glp", broken`, map[string]string{"realm": "glp"}},
+		{``, map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := parseAuthParams(tt.input); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAuthParams(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
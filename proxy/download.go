@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/whoisnian/glb/util/netutil"
+	"github.com/whoisnian/glp/ca"
+	"github.com/whoisnian/glp/global"
+)
+
+// https://docs.mitmproxy.org/stable/concepts-certificates/#quick-setup
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>glp ca certificate</title></head>
+<body>
+<h3>glp ca certificate</h3>
+<p>SHA-256 fingerprint: <code>{{.Fingerprint}}</code></p>
+<ul>
+<li><a href="/glp.pem">glp.pem</a> PEM format, for openssl and most linux tools</li>
+<li><a href="/glp.crt">glp.crt</a> DER format, for windows and android</li>
+<li><a href="/glp.cer">glp.cer</a> DER format, for macos and ios</li>
+<li><a href="/glp.p12">glp.p12</a> PKCS#12 format with empty password</li>
+<li><a href="/install.sh">install.sh</a> shell script for alpine/debian/rhel, optional query: <code>?distro=alpine|debian|rhel</code></li>
+</ul>
+<pre>wget -O- http://{{.Host}}/install.sh | sh</pre>
+</body>
+</html>
+`))
+
+var caDownloadPaths = []string{"/", "/glp.pem", "/glp.crt", "/glp.cer", "/glp.p12", "/install.sh"}
+
+func isCADownloadPath(path string) bool {
+	return slices.Contains(caDownloadPaths, path)
+}
+
+func isCAHost(hostport string) bool {
+	host, _ := netutil.SplitHostPort(hostport)
+	return global.CFG.CAHostName != "" && strings.EqualFold(host, global.CFG.CAHostName)
+}
+
+func (s *Server) handleCADownload(conn net.Conn, req *http.Request) {
+	switch req.URL.Path {
+	case "/glp.pem":
+		writeResponse(conn, http.StatusOK, attachmentHeader("application/x-pem-file", "glp.pem"), ca.CertificatePEM())
+	case "/glp.crt", "/glp.cer":
+		writeResponse(conn, http.StatusOK, attachmentHeader("application/x-x509-ca-cert", req.URL.Path[1:]), ca.CertificateDER())
+	case "/glp.p12":
+		data, err := ca.CertificatePKCS12()
+		if err != nil {
+			global.LOG.Errorf(req.Context(), "proxy: ca.CertificatePKCS12 %s %s %s", req.Method, req.URL, err.Error())
+			writeResponse(conn, http.StatusInternalServerError, http.Header{}, nil)
+			return
+		}
+		writeResponse(conn, http.StatusOK, attachmentHeader("application/x-pkcs12", "glp.p12"), data)
+	case "/install.sh":
+		distro := req.URL.Query().Get("distro")
+		if distro == "" {
+			distro = ca.DistroAuto
+		} else if distro != ca.DistroAlpine && distro != ca.DistroDebian && distro != ca.DistroRHEL {
+			writeResponse(conn, http.StatusBadRequest, http.Header{"Content-Type": {"text/plain;charset=utf-8"}}, []byte("unknown distro: "+distro+"\n"))
+			return
+		}
+		data, err := ca.InstallScript(distro)
+		if err != nil {
+			global.LOG.Errorf(req.Context(), "proxy: ca.InstallScript %s %s %s", req.Method, req.URL, err.Error())
+			writeResponse(conn, http.StatusInternalServerError, http.Header{}, nil)
+			return
+		}
+		writeResponse(conn, http.StatusOK, http.Header{"Content-Type": {"text/x-shellscript;charset=utf-8"}}, data)
+	default:
+		buf := newBuffer()
+		defer putBuffer(buf)
+
+		host := req.Host
+		if host == "" {
+			host = global.CFG.CAHostName
+		}
+		indexTemplate.Execute(buf, struct{ Fingerprint, Host string }{ca.Fingerprint(), host})
+		writeResponse(conn, http.StatusOK, http.Header{"Content-Type": {"text/html;charset=utf-8"}}, buf.Bytes())
+	}
+}
+
+func attachmentHeader(contentType string, filename string) http.Header {
+	return http.Header{
+		"Content-Type":        {contentType},
+		"Content-Disposition": {`attachment; filename="` + filename + `"`},
+	}
+}
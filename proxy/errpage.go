@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Stages where forwarding request to upstream can fail, reported in X-Glp-Error header.
+const (
+	stageRule     = "rule"     // rejected by routing rule
+	stageDNS      = "dns"      // resolving target or relay proxy
+	stageConnect  = "connect"  // connecting to target
+	stageTLS      = "tls"      // tls handshake or certificate verification with target
+	stageProxy    = "proxy"    // connecting or handshaking with relay proxy
+	stageUpstream = "upstream" // reading response from upstream
+)
+
+// stageError marks the stage where err happened, for errors that can not be told apart by type.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string { return e.err.Error() }
+func (e *stageError) Unwrap() error { return e.err }
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h3>{{.Status}} {{.StatusText}}</h3>
+<p>glp failed to forward request to <code>{{.Target}}</code> at {{.Stage}} stage.</p>
+<ul>
+<li>Route: <code>{{.Route}}</code></li>
+<li>Error: <code>{{.Err}}</code></li>
+</ul>
+</body>
+</html>
+`))
+
+// upstreamFailure describes why a request was not forwarded, and renders error page for client.
+type upstreamFailure struct {
+	Status     int
+	StatusText string
+	Stage      string
+	Target     string
+	Route      string
+	Err        string
+}
+
+func newUpstreamFailure(req *http.Request, route *upstream, err error) *upstreamFailure {
+	f := &upstreamFailure{
+		Status: upstreamErrorStatus(err),
+		Stage:  upstreamErrorStage(err),
+		Target: req.URL.Host,
+		Route:  route.name,
+		Err:    err.Error(),
+	}
+	if f.Stage == stageRule {
+		f.Status = http.StatusForbidden
+	}
+	f.StatusText = http.StatusText(f.Status)
+	return f
+}
+
+// upstreamErrorStage returns the failing stage tagged by dialer, or guesses it from err type, as errors of http.Transport are mostly not typed.
+func upstreamErrorStage(err error) string {
+	var stageErr *stageError
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errRouteRejected):
+		return stageRule
+	case errors.As(err, &dnsErr):
+		return stageDNS
+	case errors.As(err, &stageErr):
+		return stageErr.stage
+	case errors.As(err, &opErr) && opErr.Op == "proxyconnect":
+		return stageProxy
+	case errors.As(err, &opErr) && opErr.Op == "socks connect":
+		return socksErrorStage(opErr)
+	case isTLSError(err):
+		return stageTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial", errors.Is(err, context.DeadlineExceeded):
+		return stageConnect
+	}
+	return stageUpstream
+}
+
+// socksErrorStage tells whether relay proxy itself failed or it failed to reach target by reply code in error message.
+// https://cs.opensource.google/go/x/net/+/refs/tags/v0.40.0:internal/socks/client.go;l=116
+func socksErrorStage(opErr *net.OpError) string {
+	switch strings.TrimPrefix(opErr.Err.Error(), "unknown error ") {
+	case "network unreachable", "host unreachable", "connection refused", "TTL expired":
+		return stageConnect
+	}
+	return stageProxy
+}
+
+func isTLSError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &verifyErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) ||
+		errors.Is(err, errPinMismatch) || errors.Is(err, errMissingCertificate) || isTLSHandshakeTimeout(err)
+}
+
+// isTLSHandshakeTimeout matches the unexported tlsHandshakeTimeoutError of http.Transport by its net.Error semantics.
+// https://cs.opensource.google/go/go/+/refs/tags/go1.24.3:src/net/http/transport.go
+func isTLSHandshakeTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() && netErr.Error() == "net/http: TLS handshake timeout"
+}
+
+// render returns html page if client accepts it, or plain text otherwise.
+func (f *upstreamFailure) render(req *http.Request) (http.Header, []byte) {
+	header := http.Header{
+		"X-Glp-Error":   {f.Stage + ": " + strings.Join(strings.Fields(f.Err), " ")}, // keep header value in a single line
+		"Cache-Control": {"no-store"},
+	}
+	buf := new(bytes.Buffer)
+	if strings.Contains(req.Header.Get("Accept"), "text/html") {
+		header.Set("Content-Type", "text/html;charset=utf-8")
+		errorPageTemplate.Execute(buf, f)
+	} else {
+		header.Set("Content-Type", "text/plain;charset=utf-8")
+		fmt.Fprintf(buf, "%d %s\n\nTarget: %s\nRoute:  %s\nStage:  %s\nError:  %s\n", f.Status, f.StatusText, f.Target, f.Route, f.Stage, f.Err)
+	}
+	return header, buf.Bytes()
+}
+
+// writeTo writes error page as http/1.1 response to conn.
+func (f *upstreamFailure) writeTo(conn net.Conn, req *http.Request) {
+	header, body := f.render(req)
+	header.Set("Connection", "close")
+	writeResponse(conn, f.Status, header, body)
+}
+
+// serveHTTP writes error page by w, for streams of h2 connection.
+func (f *upstreamFailure) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	header, body := f.render(req)
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(f.Status)
+	w.Write(body)
+}
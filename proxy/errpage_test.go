@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUpstreamErrorStage(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	dnsErr := &net.DNSError{Err: "no such host", Name: "relay.invalid", IsNotFound: true}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"rejected", fmt.Errorf("route: %w", errRouteRejected), stageRule},
+		{"dns", dnsErr, stageDNS},
+		{"relay dns", &stageError{stageProxy, dnsErr}, stageDNS},
+		{"direct dial", dialErr, stageConnect},
+		{"relay dial", &stageError{stageProxy, dialErr}, stageProxy},
+		{"transport relay dial", &net.OpError{Op: "proxyconnect", Net: "tcp", Err: dialErr}, stageProxy},
+		{"socks relay dial", &net.OpError{Op: "socks connect", Net: "tcp", Err: dialErr}, stageProxy},
+		{"socks target", &net.OpError{Op: "socks connect", Net: "tcp", Err: errors.New("unknown error host unreachable")}, stageConnect},
+		{"socks ruleset", &net.OpError{Op: "socks connect", Net: "tcp", Err: errors.New("unknown error connection not allowed by ruleset")}, stageProxy},
+		{"tls", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, stageTLS},
+		{"response", io.ErrUnexpectedEOF, stageUpstream},
+		{"response mentioning tls", errors.New("tls: unexpected message"), stageUpstream},
+		{"tls handshake timeout text", errors.New("net/http: TLS handshake timeout"), stageUpstream},
+	}
+	for _, tt := range tests {
+		if got := upstreamErrorStage(tt.err); got != tt.want {
+			t.Errorf("%s: upstreamErrorStage(%v) = %s, want %s", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestTLSHandshakeTimeoutStage(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // never answer ClientHello
+		}
+	}()
+
+	transport := &http.Transport{TLSHandshakeTimeout: 50 * time.Millisecond}
+	req := httptest.NewRequest(http.MethodGet, "https://"+ln.Addr().String()+"/", nil)
+	req.RequestURI = ""
+	_, err = transport.RoundTrip(req)
+	if got := upstreamErrorStage(err); err == nil || got != stageTLS {
+		t.Errorf("upstreamErrorStage(%v) = %s, want %s", err, got, stageTLS)
+	}
+}
+
+func TestHttpProxyErrorStage(t *testing.T) {
+	for status, want := range map[int]string{
+		http.StatusBadGateway:         stageConnect,
+		http.StatusGatewayTimeout:     stageConnect,
+		http.StatusForbidden:          stageProxy,
+		http.StatusProxyAuthRequired:  stageProxy,
+		http.StatusServiceUnavailable: stageConnect,
+	} {
+		addr, _ := startFakeProxy(t, func(req *http.Request) fakeReply { return fakeReply{status: status} })
+		_, err := dialFakeProxy(t, newHttpProxy(&url.URL{Scheme: "http", Host: addr}))
+		if got := upstreamErrorStage(err); err == nil || got != want {
+			t.Errorf("CONNECT status %d: upstreamErrorStage(%v) = %s, want %s", status, err, got, want)
+		}
+	}
+
+	// plain http.Transport sends CONNECT by itself for relay proxy without credentials
+	addr, _ := startFakeProxy(t, func(req *http.Request) fakeReply { return fakeReply{status: http.StatusBadGateway} })
+	_, transport, err := parseProxy("http://"+addr, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = transport.RoundTrip(httptest.NewRequest(http.MethodGet, "https://"+testTarget+"/", nil))
+	if got := upstreamErrorStage(err); err == nil || got != stageConnect {
+		t.Errorf("transport CONNECT status 502: upstreamErrorStage(%v) = %s, want %s", err, got, stageConnect)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close() // nothing is listening at relay address
+	_, err = dialFakeProxy(t, newHttpProxy(&url.URL{Scheme: "http", Host: ln.Addr().String()}))
+	if got := upstreamErrorStage(err); err == nil || got != stageProxy {
+		t.Errorf("relay down: upstreamErrorStage(%v) = %s, want %s", err, got, stageProxy)
+	}
+}
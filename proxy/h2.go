@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/whoisnian/glp/global"
+	"golang.org/x/net/http2"
+)
+
+// roundTripperFunc adapts a function to http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// setupH2 prepares http2 server for intercepted tls connections that negotiated 'h2' with client.
+// The base http.Server is never started, and it is only used to send GOAWAY to all h2 connections on shutdown.
+func (s *Server) setupH2() error {
+	s.h2Base = &http.Server{}
+	s.h2Server = &http2.Server{IdleTimeout: global.CFG.IdleTimeout}
+	s.h2Proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "https"
+			pr.Out.URL.Host = pr.In.Host
+			pr.Out.Host = pr.In.Host
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"] // removed by ReverseProxy before Rewrite
+			pr.SetXForwarded()
+		},
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return s.tlsPolicy.transport(routeFrom(req.Context()).transport, req.URL.Hostname()).RoundTrip(req)
+		}),
+		FlushInterval: -1, // flush immediately for streaming responses like grpc
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if !errors.Is(err, context.Canceled) {
+				global.LOG.Errorf(req.Context(), "proxy: serveH2 %s %s %s", req.Method, req.URL, err.Error())
+			}
+			newUpstreamFailure(req, routeFrom(req.Context()), err).serveHTTP(w, req)
+		},
+	}
+	return http2.ConfigureServer(s.h2Base, s.h2Server)
+}
+
+// serveH2 serves each stream of h2 connection as a separate request, and forwards it to upstream.
+// Upstream connection speaks h2 too if server supports it, otherwise falls back to http/1.1.
+func (s *Server) serveH2(conn net.Conn, connectReq *http.Request) {
+	s.h2Server.ServeConn(conn, &http2.ServeConnOpts{
+		Context:    connectReq.Context(),
+		BaseConfig: s.h2Base,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			req.URL.Scheme = "https"
+			if req.URL.Host = req.Host; req.URL.Host == "" {
+				req.URL.Host = connectReq.URL.Host
+				req.Host = connectReq.URL.Host
+			}
+			global.LOG.Debug(req.Context(), "",
+				global.LogAttrTag("H2"),
+				global.LogAttrMethod(req.Method),
+				global.LogAttrURL(req.URL),
+			)
+			route := s.router.route(req.URL)
+			if route.rejected() {
+				global.LOG.Errorf(req.Context(), "proxy: serveH2 %s %s %s", req.Method, req.URL, errRouteRejected.Error())
+				newUpstreamFailure(req, route, errRouteRejected).serveHTTP(w, req)
+			} else {
+				s.h2Proxy.ServeHTTP(w, req.WithContext(withRoute(req.Context(), route))) // pick upstream once for each stream
+			}
+			global.LOG.Info(req.Context(), "",
+				global.LogAttrTag("H2"),
+				global.LogAttrMethod(req.Method),
+				global.LogAttrURL(req.URL),
+				global.LogAttrClient(clientAddr(req)),
+				slog.String("route", route.name),
+				global.LogAttrDuration(time.Since(start)),
+			)
+		}),
+	})
+}
@@ -1,25 +1,43 @@
 package proxy
 
 import (
+	"cmp"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/whoisnian/glb/util/netutil"
 	"github.com/whoisnian/glp/ca"
 	"github.com/whoisnian/glp/global"
+	"golang.org/x/net/http2"
 )
 
 type ServerStatus struct {
-	Goroutines int
-	CacheCap   int
-	CacheLen   int
+	Goroutines     int
+	CacheCap       int
+	CacheLen       int
+	CacheHits      uint64
+	CacheMisses    uint64
+	CacheShared    uint64
+	CacheEvictions uint64
+	CacheRenewals  uint64
+	CacheInFlight  int
+	StoreCap       int
+	StoreLen       int
+	Learned        []LearnedHost
+	Relays         []RelayStatus
 }
 
 func (s *Server) handleRequest(conn net.Conn, req *http.Request) {
@@ -34,24 +52,36 @@ func (s *Server) handleRequest(conn net.Conn, req *http.Request) {
 		buf := newBuffer()
 		defer putBuffer(buf)
 
-		length, capacity := ca.CacheStatus()
+		cacheStats := ca.CacheStatus()
+		storeLength, storeCapacity := ca.StoreStatus()
 		json.NewEncoder(buf).Encode(ServerStatus{
-			Goroutines: runtime.NumGoroutine(),
-			CacheCap:   capacity,
-			CacheLen:   length,
+			Goroutines:     runtime.NumGoroutine(),
+			CacheCap:       cacheStats.Cap,
+			CacheLen:       cacheStats.Len,
+			CacheHits:      cacheStats.Hits,
+			CacheMisses:    cacheStats.Misses,
+			CacheShared:    cacheStats.Shared,
+			CacheEvictions: cacheStats.Evictions,
+			CacheRenewals:  cacheStats.Renewals,
+			CacheInFlight:  cacheStats.InFlight,
+			StoreCap:       storeCapacity,
+			StoreLen:       storeLength,
+			Learned:        s.learned.list(),
+			Relays:         s.router.relayStatus(),
 		})
-
-		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/json;charset=utf-8\r\nContent-Length: "))
-		conn.Write([]byte(strconv.Itoa(buf.Len())))
-		conn.Write([]byte("\r\n\r\n"))
-		buf.WriteTo(conn)
+		writeResponse(conn, http.StatusOK, http.Header{"Content-Type": {"application/json;charset=utf-8"}}, buf.Bytes())
+	} else if req.Method == http.MethodGet && req.URL.Path == pacPath {
+		writeResponse(conn, http.StatusOK, http.Header{"Content-Type": {pacContentType}}, s.generatePAC(cmp.Or(req.Host, s.addr)))
+	} else if req.Method == http.MethodGet && isCADownloadPath(req.URL.Path) {
+		s.handleCADownload(conn, req)
 	} else {
-		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"))
+		writeResponse(conn, http.StatusBadRequest, http.Header{}, nil)
 	}
 	global.LOG.Info(req.Context(), "",
 		global.LogAttrTag("HTTP"),
 		global.LogAttrMethod(req.Method),
 		global.LogAttrURL(req.URL),
+		global.LogAttrClient(clientAddr(req)),
 		global.LogAttrDuration(time.Since(start)),
 	)
 }
@@ -63,16 +93,37 @@ func (s *Server) handleTCP(conn net.Conn, req *http.Request, secure bool) {
 		global.LogAttrMethod(req.Method),
 		global.LogAttrURL(req.URL),
 	)
-	upstream, err := s.dialer.Dial("tcp", req.URL.Host)
+	route := s.router.route(req.URL)
+	if route.rejected() {
+		global.LOG.Errorf(req.Context(), "proxy: handleTCP %s %s %s", req.Method, req.URL, errRouteRejected.Error())
+		return
+	}
+	upstream, err := dialUpstream(req.Context(), route.dialer, route.name, req.URL.Host)
 	if err != nil {
 		global.LOG.Errorf(req.Context(), "proxy: handleTCP %s %s %s", req.Method, req.URL, err.Error())
 		return
 	}
 	if secure {
 		hostname, _ := netutil.SplitHostPort(req.URL.Host)
-		upstream = tls.Client(upstream, &tls.Config{ServerName: hostname})
+		tlsConn := tls.Client(upstream, s.tlsPolicy.tlsConfig(hostname))
+		if err = handshakeContext(req.Context(), tlsConn); err != nil {
+			global.LOG.Errorf(req.Context(), "proxy: handleTCP %s %s %s", req.Method, req.URL, err.Error())
+			upstream.Close()
+			return
+		}
+		upstream = tlsConn
 	}
+	s.pipeTCP(conn, upstream, req, route, start)
+}
+
+// pipeTCP copies data between client conn and upstream in both directions until either side is closed.
+func (s *Server) pipeTCP(conn net.Conn, upstream net.Conn, req *http.Request, route *upstream, start time.Time) {
 	defer upstream.Close()
+	stop := context.AfterFunc(req.Context(), func() { // interrupt both directions on shutdown
+		conn.SetDeadline(time.Unix(1, 0))
+		upstream.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
 
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
@@ -86,70 +137,112 @@ func (s *Server) handleTCP(conn net.Conn, req *http.Request, secure bool) {
 		global.LogAttrTag("TCP"),
 		global.LogAttrMethod(req.Method),
 		global.LogAttrURL(req.URL),
+		global.LogAttrClient(clientAddr(req)),
+		slog.String("route", route.name),
 		global.LogAttrDuration(time.Since(start)),
 	)
 }
 
-func (s *Server) handleHTTP(conn net.Conn, req *http.Request) {
+// handleHTTP forwards req to upstream and writes response back to conn.
+// It reports whether conn can be reused for the next request.
+func (s *Server) handleHTTP(conn net.Conn, req *http.Request) (keepAlive bool) {
 	start := time.Now()
 	global.LOG.Debug(req.Context(), "",
 		global.LogAttrTag("HTTP"),
 		global.LogAttrMethod(req.Method),
 		global.LogAttrURL(req.URL),
 	)
-	res, err := s.transport.RoundTrip(req)
+	route := s.router.route(req.URL)
+	if route.rejected() {
+		global.LOG.Errorf(req.Context(), "proxy: handleHTTP %s %s %s", req.Method, req.URL, errRouteRejected.Error())
+		newUpstreamFailure(req, route, errRouteRejected).writeTo(conn, req)
+		return false
+	}
+	setXForwarded(req)
+	res, err := s.tlsPolicy.transport(route.transport, req.URL.Hostname()).RoundTrip(req)
 	if err != nil {
 		global.LOG.Errorf(req.Context(), "proxy: handleHTTP %s %s %s", req.Method, req.URL, err.Error())
-		return
+		newUpstreamFailure(req, route, err).writeTo(conn, req)
+		return false
 	}
 	defer res.Body.Close()
 
-	if w, ok := res.Body.(io.Writer); ok {
-		wg := new(sync.WaitGroup)
-		wg.Add(1)
-		go func() {
-			res.Write(conn)
-			wg.Done()
-		}()
-		io.Copy(w, conn)
-		wg.Wait()
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		s.handleUpgrade(conn, req, res)
 	} else {
-		res.Write(conn)
+		downgradeResponse(res, req)
+		res.Close = res.Close || req.Close // tell client that connection will be closed
+		keepAlive = res.Write(conn) == nil && !res.Close
 	}
 	global.LOG.Info(req.Context(), "",
 		global.LogAttrTag("HTTP"),
 		global.LogAttrMethod(req.Method),
 		global.LogAttrURL(req.URL),
+		global.LogAttrClient(clientAddr(req)),
+		slog.String("route", route.name),
 		global.LogAttrDuration(time.Since(start)),
 	)
+	return keepAlive
 }
 
 func (s *Server) handleTLS(conn net.Conn, req *http.Request) {
 	cachedConn := NewCachedConn(conn)
 	defer cachedConn.Close()
 
-	serverName, err := sniffTLSHandshakeServerName(cachedConn)
+	hello, err := sniffClientHello(cachedConn)
 	cachedConn.Rewind()
 	if err != nil {
-		global.LOG.Errorf(req.Context(), "proxy: sniffTLSHandshakeServerName %s %s %s", req.Method, req.URL, err.Error())
+		global.LOG.Errorf(req.Context(), "proxy: sniffClientHello %s %s %s", req.Method, req.URL, err.Error())
 		s.handleTCP(cachedConn, req, false)
 		return
 	}
-
-	if len(serverName) == 0 {
-		serverName, _ = netutil.SplitHostPort(req.Host)
+	req = req.WithContext(withClientHello(req.Context(), hello))
+	passthrough := s.isPassthrough(req)
+	global.LOG.Info(req.Context(), "",
+		global.LogAttrTag("TLS"),
+		global.LogAttrMethod(req.Method),
+		global.LogAttrURL(req.URL),
+		global.LogAttrClient(clientAddr(req)),
+		slog.String("sni", hello.ServerName),
+		slog.String("alpn", strings.Join(hello.ALPN, ",")),
+		slog.String("ja3", hello.JA3()),
+		slog.String("ja4", hello.JA4()),
+		slog.Bool("passthrough", passthrough),
+	)
+	if passthrough {
+		s.handleTCP(cachedConn, req, false)
+		return
 	}
-	cer, err := ca.GetCertificate(req.Context(), serverName)
+
+	cer, err := s.getCertificate(req)
 	if err != nil {
-		global.LOG.Errorf(req.Context(), "proxy: ca.GetCertificate %s %s %s", req.Method, req.URL, err.Error())
+		global.LOG.Errorf(req.Context(), "proxy: getCertificate %s %s %s", req.Method, req.URL, err.Error())
 		s.handleTCP(cachedConn, req, false)
 		return
 	}
+	nextProtos := []string{"http/1.1"}
+	if !global.CFG.HTTP1Only && !isCAHost(req.URL.Host) {
+		nextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
 	tlsConn := tls.Server(cachedConn, &tls.Config{
 		Certificates: []tls.Certificate{*cer},
+		NextProtos:   nextProtos,
 		KeyLogWriter: s.klogw,
 	})
 	defer tlsConn.Close()
+	if err = handshakeContext(req.Context(), tlsConn); err != nil {
+		if host := cmp.Or(hello.ServerName, req.URL.Hostname()); global.CFG.LearnPeriod > 0 && isCertRejection(err) {
+			s.learned.add(host, global.CFG.LearnPeriod)
+			global.LOG.Warnf(req.Context(), "proxy: learned passthrough for %s in client rejection %s for %s %s", host, err.Error(), req.Method, req.URL)
+		} else {
+			global.LOG.Warnf(req.Context(), "proxy: tls handshake with client %s for %s %s", err.Error(), req.Method, req.URL)
+		}
+		return
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		s.serveH2(tlsConn, req)
+		return
+	}
 
 	bufioConn := NewBufioConn(tlsConn)
 	defer bufioConn.Close()
@@ -157,14 +250,7 @@ func (s *Server) handleTLS(conn net.Conn, req *http.Request) {
 		global.LOG.Warnf(req.Context(), "proxy: fallback to tcp in tls error %s for %s %s", err.Error(), req.Method, req.URL)
 		s.handleTCP(bufioConn, req, true)
 	} else if sniffHTTPMethodPrefix(data) {
-		tlsReq, err := http.ReadRequest(bufioConn.Reader())
-		if err != nil {
-			global.LOG.Errorf(req.Context(), "proxy: handleTLS.ReadRequest %s %s %s", req.Method, req.URL, err.Error())
-			return
-		}
-		tlsReq.URL.Scheme = "https"
-		tlsReq.URL.Host = tlsReq.Host
-		s.handleHTTP(bufioConn, tlsReq)
+		s.serveTunnel(bufioConn, req, "https")
 	} else if sniffGcmLoginPrefix(data) {
 		s.handleTCP(bufioConn, req, true)
 	} else {
@@ -172,3 +258,128 @@ func (s *Server) handleTLS(conn net.Conn, req *http.Request) {
 		s.handleTCP(bufioConn, req, true)
 	}
 }
+
+// isPassthrough reports whether tls connection should be tunnelled without interception,
+// according to both sni in sniffed ClientHello and the host of CONNECT request, or hosts learned from client rejections.
+func (s *Server) isPassthrough(req *http.Request) bool {
+	sni, hostname := serverNameFrom(req.Context()), req.URL.Hostname()
+	return s.passthrough.match(sni) || s.passthrough.match(hostname) || s.learned.match(sni) || s.learned.match(hostname)
+}
+
+// getCertificate issues leaf certificate for client according to sni or upstream certificate.
+// The host of CONNECT request is used if client does not send sni.
+// If upstream certificate is invalid or cannot be fetched, an untrusted leaf certificate is issued to pass the error to client.
+func (s *Server) getCertificate(req *http.Request) (*tls.Certificate, error) {
+	sni := serverNameFrom(req.Context())
+	serverName := sni
+	if len(serverName) == 0 {
+		serverName, _ = netutil.SplitHostPort(req.Host)
+	}
+	if (global.CFG.UpstreamCert || global.CFG.UpstreamVerify) && !isCAHost(req.URL.Host) {
+		if upstream, err := s.upstreamCertificates(req.Context(), req.URL.Host, sni, serverName); err != nil && global.CFG.UpstreamVerify {
+			global.LOG.Warnf(req.Context(), "proxy: untrusted certificate in upstream error %s for %s %s", err.Error(), req.Method, req.URL)
+			return ca.GetUntrustedCertificate(req.Context(), serverName)
+		} else if err != nil {
+			global.LOG.Warnf(req.Context(), "proxy: fallback to sni certificate in upstream error %s for %s %s", err.Error(), req.Method, req.URL)
+		} else if global.CFG.UpstreamVerify && upstream.verifyErr != nil {
+			global.LOG.Warnf(req.Context(), "proxy: untrusted certificate for invalid upstream %s for %s %s", upstream.verifyErr.Error(), req.Method, req.URL)
+			return ca.GetUntrustedCertificate(req.Context(), serverName)
+		} else if global.CFG.UpstreamCert {
+			return ca.GetMirrorCertificate(req.Context(), upstream.certs[0], serverName)
+		}
+	}
+	return ca.GetCertificate(req.Context(), serverName)
+}
+
+// upstreamCertificates returns certificate chain of upstream server and its verify result for serverName,
+// and the result is cached for a short time to avoid an extra handshake for every intercepted connection.
+func (s *Server) upstreamCertificates(ctx context.Context, addr string, sni string, serverName string) (*upstreamCert, error) {
+	key := upstreamCertKey{addr, sni, serverName}
+	if upstream, ok := s.upstreamCerts.load(key); ok {
+		return upstream, nil
+	}
+	certs, err := s.fetchUpstreamCertificates(ctx, addr, sni)
+	if err != nil {
+		return nil, err
+	}
+	upstream := &upstreamCert{certs: certs, verifyErr: s.tlsPolicy.verify(serverName, certs)}
+	s.upstreamCerts.store(key, upstream)
+	return upstream, nil
+}
+
+// fetchUpstreamCertificates completes a tls handshake with upstream server and returns its certificate chain.
+// The certificates are not verified here, and the caller decides how to handle them.
+func (s *Server) fetchUpstreamCertificates(ctx context.Context, addr string, sni string) ([]*x509.Certificate, error) {
+	route := s.router.route(&url.URL{Host: addr})
+	if route.rejected() {
+		return nil, errRouteRejected
+	}
+	conn, err := dialUpstream(ctx, route.dialer, route.name, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	config := s.tlsPolicy.tlsConfig(sni)
+	config.InsecureSkipVerify, config.VerifyConnection = true, nil // verified by caller
+	tlsConn := tls.Client(conn, config)
+	if err = handshakeContext(ctx, tlsConn); err != nil {
+		return nil, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errMissingCertificate
+	}
+	return certs, nil
+}
+
+// setXForwarded appends client ip to X-Forwarded-For header, and sets X-Forwarded-Host and X-Forwarded-Proto,
+// in the same way as httputil.ProxyRequest.SetXForwarded for h2 streams.
+// https://cs.opensource.google/go/go/+/refs/tags/go1.24.3:src/net/http/httputil/reverseproxy.go;l=84
+func setXForwarded(req *http.Request) {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err == nil {
+		if prior := req.Header["X-Forwarded-For"]; len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		req.Header.Set("X-Forwarded-For", clientIP)
+	} else {
+		req.Header.Del("X-Forwarded-For")
+	}
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	req.Header.Set("X-Forwarded-Proto", req.URL.Scheme)
+}
+
+// downgradeResponse rewrites response from upstream to be written to http/1.x client of req.
+// Body of unknown length from h2 upstream is chunked for http/1.1 client instead of closing connection after it.
+// Http/1.0 client never receives chunked body, and connection is closed after body of unknown length.
+func downgradeResponse(res *http.Response, req *http.Request) {
+	fromH2 := res.ProtoMajor >= 2
+	if fromH2 {
+		res.Proto, res.ProtoMajor, res.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	hasBody := res.Request.Method != http.MethodHead && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotModified
+	if req.ProtoAtLeast(1, 1) {
+		if fromH2 && res.ContentLength < 0 && hasBody {
+			res.TransferEncoding = []string{"chunked"}
+		}
+		return
+	}
+	if res.ContentLength < 0 && hasBody {
+		res.TransferEncoding, res.Close = nil, true // body ends when connection is closed
+	} else if !req.Close {
+		res.Header.Set("Connection", "keep-alive") // http/1.0 client requires explicit keep-alive
+	}
+}
+
+func writeResponse(conn net.Conn, code int, header http.Header, body []byte) {
+	buf := newBuffer()
+	defer putBuffer(buf)
+
+	fmt.Fprintf(buf, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Write(buf)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	buf.WriteTo(conn)
+}
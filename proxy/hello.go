@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// https://www.iana.org/assignments/tls-extensiontype-values/tls-extensiontype-values.xhtml
+const (
+	extensionSupportedGroups     uint16 = 10
+	extensionECPointFormats      uint16 = 11
+	extensionSignatureAlgorithms uint16 = 13
+	extensionALPN                uint16 = 16
+	extensionSupportedVersions   uint16 = 43
+)
+
+// ClientHello contains fields of TLS ClientHello message that are useful for logging and routing.
+// GREASE values are kept as is, and only ignored when computing fingerprints.
+type ClientHello struct {
+	Version             uint16 // legacy_version in ClientHello
+	ServerName          string
+	ALPN                []string
+	SupportedVersions   []uint16
+	CipherSuites        []uint16
+	Extensions          []uint16 // extension types in original order
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+}
+
+type clientHelloKey struct{}
+
+func withClientHello(ctx context.Context, hello *ClientHello) context.Context {
+	return context.WithValue(ctx, clientHelloKey{}, hello)
+}
+
+// clientHelloFrom returns the ClientHello sniffed from intercepted connection, or nil if not available.
+func clientHelloFrom(ctx context.Context) *ClientHello {
+	hello, _ := ctx.Value(clientHelloKey{}).(*ClientHello)
+	return hello
+}
+
+// serverNameFrom returns sni in the sniffed ClientHello, or empty string if not available.
+func serverNameFrom(ctx context.Context) string {
+	if hello := clientHelloFrom(ctx); hello != nil {
+		return hello.ServerName
+	}
+	return ""
+}
+
+// byteReader is a bounds-checked reader like golang.org/x/crypto/cryptobyte.
+// Every read method returns false instead of panicking if data is not long enough.
+type byteReader []byte
+
+func (r *byteReader) readBytes(n int, out *[]byte) bool {
+	if n < 0 || len(*r) < n {
+		return false
+	}
+	*out, *r = (*r)[:n], (*r)[n:]
+	return true
+}
+
+func (r *byteReader) readUint8(out *uint8) bool {
+	var b []byte
+	if !r.readBytes(1, &b) {
+		return false
+	}
+	*out = b[0]
+	return true
+}
+
+func (r *byteReader) readUint16(out *uint16) bool {
+	var b []byte
+	if !r.readBytes(2, &b) {
+		return false
+	}
+	*out = uint16(b[0])<<8 | uint16(b[1])
+	return true
+}
+
+func (r *byteReader) readUint24(out *int) bool {
+	var b []byte
+	if !r.readBytes(3, &b) {
+		return false
+	}
+	*out = int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	return true
+}
+
+func (r *byteReader) readUint8Prefixed(out *byteReader) bool {
+	var n uint8
+	var b []byte
+	if !r.readUint8(&n) || !r.readBytes(int(n), &b) {
+		return false
+	}
+	*out = b
+	return true
+}
+
+func (r *byteReader) readUint16Prefixed(out *byteReader) bool {
+	var n uint16
+	var b []byte
+	if !r.readUint16(&n) || !r.readBytes(int(n), &b) {
+		return false
+	}
+	*out = b
+	return true
+}
+
+func (r *byteReader) readUint16List(out *[]uint16) bool {
+	var list byteReader
+	if !r.readUint16Prefixed(&list) || len(list)%2 != 0 {
+		return false
+	}
+	for len(list) > 0 {
+		var v uint16
+		list.readUint16(&v)
+		*out = append(*out, v)
+	}
+	return true
+}
+
+var errInvalidClientHello = errors.New("proxy: invalid TLS client hello")
+
+// https://datatracker.ietf.org/doc/html/rfc8446#section-4.1.2
+// https://cs.opensource.google/go/go/+/refs/tags/go1.24.3:src/crypto/tls/handshake_messages.go;l=369
+func parseClientHello(data []byte) (*ClientHello, error) {
+	r := byteReader(data)
+	var msgType uint8
+	var msgLength int
+	if !r.readUint8(&msgType) || msgType != messageTypeClientHello {
+		return nil, errors.New("proxy: invalid TLS client hello message type")
+	}
+	if !r.readUint24(&msgLength) || msgLength > len(r) {
+		return nil, errors.New("proxy: fragmented TLS client hello is not supported")
+	}
+	r = r[:msgLength]
+
+	hello := &ClientHello{}
+	var random []byte
+	var sessionID, cipherSuites, compressionMethods byteReader
+	if !r.readUint16(&hello.Version) ||
+		!r.readBytes(32, &random) ||
+		!r.readUint8Prefixed(&sessionID) ||
+		!r.readUint16Prefixed(&cipherSuites) || len(cipherSuites)%2 != 0 ||
+		!r.readUint8Prefixed(&compressionMethods) {
+		return nil, errInvalidClientHello
+	}
+	for len(cipherSuites) > 0 {
+		var suite uint16
+		cipherSuites.readUint16(&suite)
+		hello.CipherSuites = append(hello.CipherSuites, suite)
+	}
+	if len(r) == 0 {
+		return hello, nil // ClientHello without extensions
+	}
+
+	var extensions byteReader
+	if !r.readUint16Prefixed(&extensions) || len(r) != 0 {
+		return nil, errors.New("proxy: invalid TLS client hello extensions length")
+	}
+	for len(extensions) > 0 {
+		var extType uint16
+		var extData byteReader
+		if !extensions.readUint16(&extType) || !extensions.readUint16Prefixed(&extData) {
+			return nil, errInvalidClientHello
+		}
+		hello.Extensions = append(hello.Extensions, extType)
+		if !hello.parseExtension(extType, extData) {
+			return nil, fmt.Errorf("proxy: invalid TLS client hello extension %d", extType)
+		}
+	}
+	return hello, nil
+}
+
+func (hello *ClientHello) parseExtension(extType uint16, data byteReader) bool {
+	switch extType {
+	case extensionServerName: // https://datatracker.ietf.org/doc/html/rfc6066#section-3
+		var names byteReader
+		if !data.readUint16Prefixed(&names) {
+			return false
+		}
+		for len(names) > 0 {
+			var nameType uint8
+			var name byteReader
+			if !names.readUint8(&nameType) || !names.readUint16Prefixed(&name) {
+				return false
+			}
+			if nameType == 0 && len(name) > 0 && hello.ServerName == "" {
+				hello.ServerName = string(name)
+			}
+		}
+	case extensionALPN: // https://datatracker.ietf.org/doc/html/rfc7301#section-3.1
+		var protocols byteReader
+		if !data.readUint16Prefixed(&protocols) {
+			return false
+		}
+		for len(protocols) > 0 {
+			var proto byteReader
+			if !protocols.readUint8Prefixed(&proto) || len(proto) == 0 {
+				return false
+			}
+			hello.ALPN = append(hello.ALPN, string(proto))
+		}
+	case extensionSupportedVersions: // https://datatracker.ietf.org/doc/html/rfc8446#section-4.2.1
+		var versions byteReader
+		if !data.readUint8Prefixed(&versions) || len(versions)%2 != 0 {
+			return false
+		}
+		for len(versions) > 0 {
+			var v uint16
+			versions.readUint16(&v)
+			hello.SupportedVersions = append(hello.SupportedVersions, v)
+		}
+	case extensionSupportedGroups:
+		return data.readUint16List(&hello.SupportedGroups)
+	case extensionSignatureAlgorithms:
+		return data.readUint16List(&hello.SignatureAlgorithms)
+	case extensionECPointFormats:
+		var formats byteReader
+		if !data.readUint8Prefixed(&formats) {
+			return false
+		}
+		hello.PointFormats = append(hello.PointFormats, formats...)
+	}
+	return true
+}
+
+// https://datatracker.ietf.org/doc/html/rfc8701#section-2
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	result := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func joinUint16(values []uint16, sep string, format func(uint16) string) string {
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = format(v)
+	}
+	return strings.Join(items, sep)
+}
+
+func decimal(v uint16) string { return strconv.Itoa(int(v)) }
+func hex4(v uint16) string    { return fmt.Sprintf("%04x", v) }
+
+// JA3 returns md5 of 'SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats'.
+// https://github.com/salesforce/ja3/blob/master/README.md
+func (hello *ClientHello) JA3() string {
+	formats := make([]uint16, len(hello.PointFormats))
+	for i, f := range hello.PointFormats {
+		formats[i] = uint16(f)
+	}
+	raw := strings.Join([]string{
+		decimal(hello.Version),
+		joinUint16(withoutGREASE(hello.CipherSuites), "-", decimal),
+		joinUint16(withoutGREASE(hello.Extensions), "-", decimal),
+		joinUint16(withoutGREASE(hello.SupportedGroups), "-", decimal),
+		joinUint16(formats, "-", decimal),
+	}, ",")
+	sum := md5.Sum([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the 'a_b_c' fingerprint for TLS over TCP.
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func (hello *ClientHello) JA4() string {
+	version := hello.Version
+	if versions := withoutGREASE(hello.SupportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	versionStr := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3"}[version]
+	if versionStr == "" {
+		versionStr = "00"
+	}
+	sni := "i"
+	if hello.ServerName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(hello.ALPN) > 0 && len(hello.ALPN[0]) > 0 {
+		first := hello.ALPN[0]
+		if !isAlnum(first[0]) || !isAlnum(first[len(first)-1]) {
+			first = hex.EncodeToString([]byte(first)) // first and last characters of hex representation instead
+		}
+		alpn = first[:1] + first[len(first)-1:]
+	}
+	ciphers := withoutGREASE(hello.CipherSuites)
+	extensions := withoutGREASE(hello.Extensions)
+	a := fmt.Sprintf("t%s%s%02d%02d%s", versionStr, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	slices.Sort(ciphers)
+	b := ja4Hash(joinUint16(ciphers, ",", hex4))
+
+	sorted := make([]uint16, 0, len(extensions))
+	for _, ext := range extensions {
+		if ext != extensionServerName && ext != extensionALPN {
+			sorted = append(sorted, ext)
+		}
+	}
+	slices.Sort(sorted)
+	c := joinUint16(sorted, ",", hex4)
+	if algorithms := withoutGREASE(hello.SignatureAlgorithms); len(algorithms) > 0 {
+		c += "_" + joinUint16(algorithms, ",", hex4)
+	}
+	if len(sorted) == 0 {
+		c = ""
+	}
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+func isAlnum(c byte) bool {
+	return '0' <= c && c <= '9' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z'
+}
+
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
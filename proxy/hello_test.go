@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"slices"
+	"testing"
+)
+
+// curlClientHello is a tls record captured from 'curl https://example.com' with curl 7.88.1 and OpenSSL 3.0.17.
+var curlClientHello = mustDecodeHex("" +
+	"1603010200010001fc0303026feecf979c54af187f20e794c8f77f4a81d57257" +
+	"c206da111457f337516f9020a4f45b46874d2dec4969a57b46bc4a9495bf36e7" +
+	"f529cd95939ad56fea96510f003e130213031301c02cc030009fcca9cca8ccaa" +
+	"c02bc02f009ec024c028006bc023c0270067c00ac0140039c009c0130033009d" +
+	"009c003d003c0035002f00ff0100017500000010000e00000b6578616d706c65" +
+	"2e636f6d000b000403000102000a00160014001d0017001e0019001801000101" +
+	"0102010301040010000e000c02683208687474702f312e310016000000170000" +
+	"00310000000d002a0028040305030603080708080809080a080b080408050806" +
+	"040105010601030303010302040205020602002b000908030403030302030100" +
+	"2d00020101003300260024001d00208a087fa0842a39bbd64b3db2e6f6ed2b66" +
+	"8741e7bdffec2feafdcf06a6954c4d001500b200000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" +
+	"0000000000")
+
+func mustDecodeHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+type testExtension struct {
+	typ  uint16
+	data []byte
+}
+
+// buildClientHello encodes a ClientHello handshake message without record header.
+func buildClientHello(version uint16, ciphers []uint16, extensions []testExtension) []byte {
+	body := binary.BigEndian.AppendUint16(nil, version)
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // empty session id
+	body = binary.BigEndian.AppendUint16(body, uint16(2*len(ciphers)))
+	for _, c := range ciphers {
+		body = binary.BigEndian.AppendUint16(body, c)
+	}
+	body = append(body, 1, 0) // null compression
+	if extensions != nil {
+		var exts []byte
+		for _, ext := range extensions {
+			exts = binary.BigEndian.AppendUint16(exts, ext.typ)
+			exts = binary.BigEndian.AppendUint16(exts, uint16(len(ext.data)))
+			exts = append(exts, ext.data...)
+		}
+		body = binary.BigEndian.AppendUint16(body, uint16(len(exts)))
+		body = append(body, exts...)
+	}
+	msg := []byte{messageTypeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...)
+}
+
+func sniExtension(name string) testExtension {
+	data := binary.BigEndian.AppendUint16(nil, uint16(len(name)+3))
+	data = append(data, 0)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(name)))
+	return testExtension{extensionServerName, append(data, name...)}
+}
+
+func alpnExtension(protos ...string) testExtension {
+	var list []byte
+	for _, p := range protos {
+		list = append(append(list, byte(len(p))), p...)
+	}
+	return testExtension{extensionALPN, append(binary.BigEndian.AppendUint16(nil, uint16(len(list))), list...)}
+}
+
+func uint16ListExtension(typ uint16, values ...uint16) testExtension {
+	data := binary.BigEndian.AppendUint16(nil, uint16(2*len(values)))
+	for _, v := range values {
+		data = binary.BigEndian.AppendUint16(data, v)
+	}
+	return testExtension{typ, data}
+}
+
+func versionsExtension(versions ...uint16) testExtension {
+	data := []byte{byte(2 * len(versions))}
+	for _, v := range versions {
+		data = binary.BigEndian.AppendUint16(data, v)
+	}
+	return testExtension{extensionSupportedVersions, data}
+}
+
+func emptyExtensions(types ...uint16) []testExtension {
+	result := make([]testExtension, len(types))
+	for i, typ := range types {
+		result[i] = testExtension{typ: typ}
+	}
+	return result
+}
+
+// Expected values are from real clients or examples in JA3 and JA4 documents:
+// https://github.com/salesforce/ja3/blob/master/README.md
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func TestClientHelloFingerprints(t *testing.T) {
+	chromeSigAlgs := []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601}
+	firefoxSigAlgs := []uint16{0x0403, 0x0503, 0x0603, 0x0804, 0x0805, 0x0806, 0x0401, 0x0501, 0x0601, 0x0203, 0x0201}
+	tests := []struct {
+		name string
+		data []byte
+		sni  string
+		alpn []string
+		ja3  string
+		ja4  string
+	}{
+		{
+			name: "curl",
+			data: curlClientHello[recordHeaderLen:],
+			sni:  "example.com",
+			alpn: []string{"h2", "http/1.1"},
+			ja3:  "0149f47eabf9a20d0893e2a44e5a6323",
+			ja4:  "t13d3112h2_e8f1e7e78f70_b26ce05bbdd6",
+		},
+		{
+			name: "chrome",
+			data: buildClientHello(0x0303,
+				[]uint16{0x3a3a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+				slices.Concat(
+					emptyExtensions(0x2a2a, 0x0017, 0x0023, 0xff01, 0x0012, 0x0005, 0x001b, 0x0033, 0x002d, 0x0015, 0x4469),
+					[]testExtension{
+						sniExtension("www.google.com"),
+						alpnExtension("h2", "http/1.1"),
+						versionsExtension(0x5a5a, 0x0304, 0x0303),
+						uint16ListExtension(extensionSupportedGroups, 0x4a4a, 0x001d, 0x0017, 0x0018),
+						{extensionECPointFormats, []byte{1, 0}},
+						uint16ListExtension(extensionSignatureAlgorithms, chromeSigAlgs...),
+					},
+					emptyExtensions(0x1a1a),
+				),
+			),
+			sni:  "www.google.com",
+			alpn: []string{"h2", "http/1.1"},
+			ja4:  "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "firefox",
+			data: buildClientHello(0x0303,
+				[]uint16{0x1301, 0x1303, 0x1302, 0xc02b, 0xc02f, 0xcca9, 0xcca8, 0xc02c, 0xc030, 0xc00a, 0xc009, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+				slices.Concat(
+					[]testExtension{sniExtension("www.mozilla.org")},
+					emptyExtensions(0x0017, 0xff01),
+					[]testExtension{
+						uint16ListExtension(extensionSupportedGroups, 0x001d, 0x0017, 0x0018, 0x0019, 0x0100, 0x0101),
+						{extensionECPointFormats, []byte{1, 0}},
+					},
+					emptyExtensions(0x0023),
+					[]testExtension{alpnExtension("h2", "http/1.1")},
+					emptyExtensions(0x0005, 0x0022, 0x0033),
+					[]testExtension{
+						versionsExtension(0x0304, 0x0303),
+						uint16ListExtension(extensionSignatureAlgorithms, firefoxSigAlgs...),
+					},
+					emptyExtensions(0x002d, 0x001c, 0x0015),
+				),
+			),
+			sni:  "www.mozilla.org",
+			alpn: []string{"h2", "http/1.1"},
+			ja4:  "t13d1715h2_5b57614c22b0_3d5424432f57",
+		},
+		{
+			name: "ja3 readme",
+			data: buildClientHello(0x0301,
+				[]uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+				[]testExtension{
+					sniExtension("example.com"),
+					uint16ListExtension(extensionSupportedGroups, 23, 24, 25),
+					{extensionECPointFormats, []byte{1, 0}},
+				},
+			),
+			sni: "example.com",
+			ja3: "ada70206e40642a3e4461f35503241d5",
+		},
+		{
+			name: "ja3 readme without extensions",
+			data: buildClientHello(0x0301, []uint16{4, 5, 10, 9, 100, 98, 3, 6, 19, 18, 99}, nil),
+			ja3:  "de350869b8c85de67a350c8d186f11e6",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := parseClientHello(tt.data)
+			if err != nil {
+				t.Fatalf("parseClientHello: %v", err)
+			}
+			if hello.ServerName != tt.sni {
+				t.Errorf("ServerName = %q, want %q", hello.ServerName, tt.sni)
+			}
+			if !slices.Equal(hello.ALPN, tt.alpn) {
+				t.Errorf("ALPN = %q, want %q", hello.ALPN, tt.alpn)
+			}
+			if ja3 := hello.JA3(); tt.ja3 != "" && ja3 != tt.ja3 {
+				t.Errorf("JA3 = %s, want %s", ja3, tt.ja3)
+			}
+			if ja4 := hello.JA4(); tt.ja4 != "" && ja4 != tt.ja4 {
+				t.Errorf("JA4 = %s, want %s", ja4, tt.ja4)
+			}
+		})
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	tests := []struct {
+		alpn []string
+		want string
+	}{
+		{nil, "00"},
+		{[]string{"h2"}, "h2"},
+		{[]string{"http/1.1"}, "h1"},
+		{[]string{"h3-29"}, "h9"},
+		{[]string{"\xab\xcd"}, "ad"}, // non-alphanumeric both, hex 'abcd'
+		{[]string{"h2\xff"}, "6f"},   // non-alphanumeric last, hex '6832ff'
+		{[]string{"/h"}, "28"},       // non-alphanumeric first, hex '2f68'
+	}
+	for _, tt := range tests {
+		exts := []testExtension{}
+		if tt.alpn != nil {
+			exts = append(exts, alpnExtension(tt.alpn...))
+		}
+		hello, err := parseClientHello(buildClientHello(0x0303, []uint16{0x1301}, exts))
+		if err != nil {
+			t.Fatalf("parseClientHello: %v", err)
+		}
+		if got := hello.JA4()[8:10]; got != tt.want {
+			t.Errorf("JA4 alpn of %q = %s, want %s", tt.alpn, got, tt.want)
+		}
+	}
+}
+
+func TestParseClientHelloInvalid(t *testing.T) {
+	valid := curlClientHello[recordHeaderLen:]
+	for n := range valid {
+		if _, err := parseClientHello(valid[:n]); err == nil {
+			t.Errorf("parseClientHello accepted message truncated to %d bytes", n)
+		}
+	}
+	for _, ext := range []testExtension{
+		{extensionServerName, []byte{0, 10, 0, 0, 20, 'a'}}, // name longer than list
+		{extensionALPN, []byte{0, 3, 5, 'h', '2'}},          // protocol longer than list
+		{extensionALPN, []byte{0, 1, 0}},                    // empty protocol
+		{extensionSupportedVersions, []byte{3, 3, 4, 3}},    // odd length
+		{extensionSupportedGroups, []byte{0, 4, 0, 29}},     // list longer than extension
+		{extensionSignatureAlgorithms, []byte{0xff, 0xff}},  // oversized length
+		{extensionECPointFormats, []byte{2, 0}},             // list longer than extension
+	} {
+		if _, err := parseClientHello(buildClientHello(0x0303, []uint16{0x1301}, []testExtension{ext})); err == nil {
+			t.Errorf("parseClientHello accepted invalid extension %d %x", ext.typ, ext.data)
+		}
+	}
+}
+
+func FuzzParseClientHello(f *testing.F) {
+	valid := curlClientHello[recordHeaderLen:]
+	f.Add(valid)
+	f.Add(valid[:len(valid)/2])               // truncated message
+	f.Add(buildClientHello(0x0303, nil, nil)) // no cipher suites and extensions
+	oversized := slices.Clone(valid)
+	oversized[1], oversized[2], oversized[3] = 0xff, 0xff, 0xff // oversized message length
+	f.Add(oversized)
+	oversized = slices.Clone(valid)
+	oversized[4+2+32+1+int(valid[4+2+32])] = 0xff // oversized cipher suites length
+	f.Add(oversized)
+	f.Add(buildClientHello(0x0303, []uint16{0x1301}, []testExtension{{extensionServerName, []byte{0xff, 0xff, 0}}}))  // oversized sni list
+	f.Add(buildClientHello(0x0303, []uint16{0x1301}, []testExtension{{extensionALPN, []byte{0, 2, 0xff, 'h'}}}))      // oversized protocol
+	f.Add(buildClientHello(0x0303, []uint16{0x1301}, []testExtension{{extensionSupportedVersions, []byte{0xff, 3}}})) // oversized versions
+	truncated := buildClientHello(0x0303, []uint16{0x1301}, []testExtension{alpnExtension("h2")})
+	f.Add(truncated[:len(truncated)-1]) // truncated extension
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hello, err := parseClientHello(data)
+		if err != nil {
+			return
+		}
+		hello.JA3()
+		hello.JA4()
+	})
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certRejectAlerts are tls alerts sent by clients that do not trust the intercepted certificate,
+// which usually means the client pins upstream certificate or does not install our ca certificate.
+// https://www.rfc-editor.org/rfc/rfc8446#section-6.2
+var certRejectAlerts = []string{
+	"tls: bad certificate",
+	"tls: unsupported certificate",
+	"tls: unknown certificate",
+	"tls: unknown certificate authority",
+}
+
+// isCertRejection reports whether err is caused by client rejecting our certificate during tls handshake.
+func isCertRejection(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" {
+		return false
+	}
+	return slices.Contains(certRejectAlerts, opErr.Err.Error())
+}
+
+type LearnedHost struct {
+	Host  string
+	Until time.Time
+}
+
+// learnedHosts records hosts whose clients rejected intercepted certificates, and they are passed through until expiry.
+type learnedHosts struct {
+	hosts map[string]time.Time // host => expiry
+	mu    sync.Mutex
+}
+
+func (l *learnedHosts) add(host string, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hosts == nil {
+		l.hosts = make(map[string]time.Time)
+	}
+	l.pruneLocked(time.Now())
+	l.hosts[strings.ToLower(host)] = time.Now().Add(ttl)
+}
+
+func (l *learnedHosts) match(host string) bool {
+	if host == "" {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.hosts[strings.ToLower(host)]
+	return ok && time.Now().Before(until)
+}
+
+func (l *learnedHosts) list() []LearnedHost {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked(time.Now())
+	result := make([]LearnedHost, 0, len(l.hosts))
+	for host, until := range l.hosts {
+		result = append(result, LearnedHost{Host: host, Until: until})
+	}
+	slices.SortFunc(result, func(a, b LearnedHost) int { return strings.Compare(a.Host, b.Host) })
+	return result
+}
+
+func (l *learnedHosts) pruneLocked(now time.Time) {
+	for host, until := range l.hosts {
+		if !now.Before(until) {
+			delete(l.hosts, host)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/whoisnian/glp/global"
+)
+
+func TestMain(m *testing.M) {
+	global.SetupLogger(context.Background())
+	os.Exit(m.Run())
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"errors"
+	"net/netip"
+	"path"
+	"strings"
+)
+
+// splitList splits comma separated values from command line, and ignores empty items.
+func splitList(s string) (result []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// matchHost reports whether host matches the pattern, which can be exact hostname or glob like '*.example.com'.
+func matchHost(pattern string, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern == host {
+		return true
+	}
+	ok, _ := path.Match(pattern, host)
+	return ok
+}
+
+func matchHostAny(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatcher matches host against host patterns and CIDR prefixes like '10.0.0.0/8'.
+type hostMatcher struct {
+	patterns []string
+	prefixes []netip.Prefix
+}
+
+// newHostMatcher creates matcher from comma separated items, and items containing '/' are parsed as CIDR prefixes.
+func newHostMatcher(items string) (*hostMatcher, error) {
+	m := &hostMatcher{}
+	for _, item := range splitList(items) {
+		if !strings.Contains(item, "/") {
+			m.patterns = append(m.patterns, item)
+		} else if prefix, err := netip.ParsePrefix(item); err != nil {
+			return nil, errors.New("proxy: invalid CIDR: " + item)
+		} else {
+			m.prefixes = append(m.prefixes, prefix.Masked())
+		}
+	}
+	return m, nil
+}
+
+func (m *hostMatcher) match(host string) bool {
+	if host == "" {
+		return false
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range m.prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return matchHostAny(m.patterns, host)
+}
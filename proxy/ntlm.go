@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLMv2 challenge/response for authenticating to upstream proxies, without signing or sealing.
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-nlmp/b38c36ed-2804-4868-a9ff-8dd3182128e4
+const (
+	ntlmNegotiateUnicode    = 0x00000001
+	ntlmNegotiateOEM        = 0x00000002
+	ntlmRequestTarget       = 0x00000004
+	ntlmNegotiateNTLM       = 0x00000200
+	ntlmNegotiateAlwaysSign = 0x00008000
+	ntlmNegotiateExtended   = 0x00080000
+
+	ntlmAvEOL       = 0x0000
+	ntlmAvTimestamp = 0x0007
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmNegotiate returns the first NEGOTIATE_MESSAGE without domain and workstation.
+func ntlmNegotiate() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateUnicode|ntlmNegotiateOEM|ntlmRequestTarget|ntlmNegotiateNTLM|ntlmNegotiateAlwaysSign|ntlmNegotiateExtended)
+	return msg
+}
+
+type ntlmChallenge struct {
+	flags           uint32
+	serverChallenge []byte
+	targetInfo      []byte
+}
+
+// parseNTLMChallenge parses CHALLENGE_MESSAGE from server.
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 48 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("proxy: invalid NTLM challenge message")
+	}
+	c := &ntlmChallenge{
+		flags:           binary.LittleEndian.Uint32(msg[20:]),
+		serverChallenge: msg[24:32],
+	}
+	length, offset := int(binary.LittleEndian.Uint16(msg[40:])), int(binary.LittleEndian.Uint32(msg[44:]))
+	if offset+length > len(msg) {
+		return nil, errors.New("proxy: invalid NTLM target info")
+	}
+	c.targetInfo = msg[offset : offset+length]
+	return c, nil
+}
+
+// timestamp returns MsvAvTimestamp in target info, or nil if not present.
+func (c *ntlmChallenge) timestamp() []byte {
+	for info := c.targetInfo; len(info) >= 4; {
+		id, length := binary.LittleEndian.Uint16(info), int(binary.LittleEndian.Uint16(info[2:]))
+		if id == ntlmAvEOL || len(info) < 4+length {
+			break
+		} else if id == ntlmAvTimestamp && length == 8 {
+			return info[4:12]
+		}
+		info = info[4+length:]
+	}
+	return nil
+}
+
+// ntlmAuthenticate returns AUTHENTICATE_MESSAGE with NTLMv2 response for challenge.
+// Username can be in 'DOMAIN\user' format, and the domain is empty otherwise.
+func ntlmAuthenticate(c *ntlmChallenge, username string, password string) []byte {
+	domain, user, ok := strings.Cut(username, `\`)
+	if !ok {
+		domain, user = "", username
+	}
+	clientChallenge := make([]byte, 8)
+	rand.Read(clientChallenge)
+
+	serverTime := c.timestamp()
+	timestamp := serverTime
+	if timestamp == nil {
+		timestamp = binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()/100+116444736000000000)) // 100ns since 1601
+	}
+	ntResponse, lmProof := ntlmV2Response(ntowfV2(user, password, domain), c.serverChallenge, clientChallenge, timestamp, c.targetInfo)
+	lmResponse := make([]byte, 24) // should be zero if server provides timestamp
+	if serverTime == nil {
+		lmResponse = append(lmProof, clientChallenge...)
+	}
+
+	payloads := [][]byte{lmResponse, ntResponse, ntlmUnicode(domain), ntlmUnicode(user), nil, nil} // workstation and session key are empty
+	msg := make([]byte, 64, 64+len(lmResponse)+len(ntResponse)+2*len(domain)+2*len(user))
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, payload := range payloads {
+		binary.LittleEndian.PutUint16(msg[12+8*i:], uint16(len(payload)))
+		binary.LittleEndian.PutUint16(msg[14+8*i:], uint16(len(payload)))
+		binary.LittleEndian.PutUint32(msg[16+8*i:], uint32(len(msg)))
+		msg = append(msg, payload...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], c.flags&^ntlmNegotiateOEM|ntlmNegotiateUnicode)
+	return msg
+}
+
+// ntowfV2 returns HMAC_MD5(MD4(UNICODE(password)), UNICODE(Upper(user) + domain)).
+func ntowfV2(user string, password string, domain string) []byte {
+	h := md4.New()
+	h.Write(ntlmUnicode(password))
+	mac := hmac.New(md5.New, h.Sum(nil))
+	mac.Write(ntlmUnicode(strings.ToUpper(user) + domain))
+	return mac.Sum(nil)
+}
+
+// ntlmV2Response returns NtChallengeResponse and the proof part of LmChallengeResponse.
+func ntlmV2Response(key []byte, serverChallenge []byte, clientChallenge []byte, timestamp []byte, targetInfo []byte) (ntResponse []byte, lmProof []byte) {
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	mac := hmac.New(md5.New, key)
+	mac.Write(serverChallenge)
+	mac.Write(temp)
+	ntResponse = append(mac.Sum(nil), temp...)
+
+	mac.Reset()
+	mac.Write(serverChallenge)
+	mac.Write(clientChallenge)
+	return ntResponse, mac.Sum(nil)
+}
+
+func ntlmUnicode(s string) []byte {
+	result := make([]byte, 0, 2*len(s))
+	for _, c := range utf16.Encode([]rune(s)) {
+		result = binary.LittleEndian.AppendUint16(result, c)
+	}
+	return result
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/whoisnian/glp/global"
+)
+
+// https://github.com/torvalds/linux/blob/v6.14/include/uapi/linux/netfilter_ipv4.h#L52
+// https://github.com/torvalds/linux/blob/v6.14/include/uapi/linux/netfilter_ipv6/ip6_tables.h#L178
+// https://github.com/torvalds/linux/blob/v6.14/include/uapi/linux/in6.h#L259
+const (
+	soOriginalDst   = 80
+	ip6tOriginalDst = 80
+	ipv6Transparent = 75
+)
+
+// transparentListenConfig sets IP_TRANSPARENT on listener, so that connections redirected by TPROXY can be accepted.
+// It requires CAP_NET_ADMIN, and listener without it still works for iptables REDIRECT.
+// https://docs.kernel.org/networking/tproxy.html
+func transparentListenConfig() net.ListenConfig {
+	return net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sysErr error
+		err := c.Control(func(fd uintptr) {
+			if network == "tcp4" {
+				sysErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			} else {
+				sysErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+			}
+		})
+		if err != nil {
+			return err
+		} else if sysErr != nil {
+			global.LOG.Warnf(context.Background(), "proxy: TPROXY is unavailable on %s for setting IP_TRANSPARENT failed: %s", address, sysErr.Error())
+		}
+		return nil
+	}}
+}
+
+// originalDst returns the destination before iptables REDIRECT from conntrack.
+// The syscall package lacks a generic getsockopt, so sockaddr_in is read into IPv6Mreq(20 bytes),
+// and sockaddr_in6 is read into IPv6MTUInfo(32 bytes) whose first field is RawSockaddrInet6.
+func originalDst(conn net.Conn) (dst netip.AddrPort, err error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return dst, errors.New("proxy: original destination requires tcp connection")
+	}
+	local, err := netip.ParseAddrPort(tcpConn.LocalAddr().String())
+	if err != nil {
+		return dst, err
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return dst, err
+	}
+
+	var sysErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if local.Addr().Unmap().Is4() {
+			var mreq *syscall.IPv6Mreq
+			if mreq, sysErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst); sysErr == nil {
+				addr := mreq.Multiaddr // family(2) + port(2) + addr(4) + zero(8)
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(addr[4:8])), binary.BigEndian.Uint16(addr[2:4]))
+			}
+		} else {
+			var info *syscall.IPv6MTUInfo
+			if info, sysErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tOriginalDst); sysErr == nil {
+				var port [2]byte // network byte order in host order field
+				binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+				dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port[:]))
+			}
+		}
+	})
+	if err != nil {
+		return dst, err
+	}
+	return dst, sysErr
+}
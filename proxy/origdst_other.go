@@ -0,0 +1,17 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+func originalDst(_ net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("proxy: transparent proxy is only supported on linux")
+}
+
+func transparentListenConfig() net.ListenConfig {
+	return net.ListenConfig{}
+}
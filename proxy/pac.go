@@ -0,0 +1,469 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/whoisnian/glb/util/fsutil"
+	"github.com/whoisnian/glp/global"
+)
+
+const (
+	pacPath        = "/proxy.pac"
+	pacContentType = "application/x-ns-proxy-autoconfig"
+	pacEvalTimeout = 5 * time.Second
+	pacDNSTimeout  = 2 * time.Second
+)
+
+// isPACRequest reports whether req fetches the generated proxy.pac from glp itself.
+// Browsers do not send proxy credentials for it, so it is exempted from authentication.
+func isPACRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet && req.URL.Host == "" && req.URL.Path == pacPath
+}
+
+// generatePAC returns proxy.pac that sends clients to proxyAddr, except for destinations glp would connect directly anyway:
+// routing rules to 'direct' upstream, and passthrough rules if the default upstream is direct.
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Guides/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file
+func (s *Server) generatePAC(proxyAddr string) []byte {
+	var b strings.Builder
+	b.WriteString("// generated by glp\n")
+	b.WriteString("function glpIsIP(host) {\n\treturn /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n}\n\n")
+	b.WriteString("function glpPort(url) {\n")
+	b.WriteString("\tvar m = /^([a-z0-9+.-]+):\\/\\/(?:[^@\\/]*@)?(?:\\[[^\\]]*\\]|[^:\\/]*)(?::(\\d+))?/i.exec(url);\n")
+	b.WriteString("\treturn !m ? \"\" : m[2] ? m[2] : /^(https|wss)$/i.test(m[1]) ? \"443\" : \"80\";\n}\n\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tvar proxy = " + jsString("PROXY "+proxyAddr) + ";\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+	for _, rule := range s.router.rules {
+		result := "proxy"
+		if rule.upstream.name == routeDirect {
+			result = `"DIRECT"`
+		}
+		fmt.Fprintf(&b, "\tif (%s) return %s; // %s=%s\n", pacCondition(rule.pattern, rule.port, rule.prefix), result, rule.pattern, rule.upstream.name)
+	}
+	if s.proxy == "" {
+		for _, pattern := range s.passthrough.patterns {
+			fmt.Fprintf(&b, "\tif (%s) return \"DIRECT\"; // passthrough\n", pacCondition(strings.ToLower(pattern), "", netip.Prefix{}))
+		}
+		for _, prefix := range s.passthrough.prefixes {
+			fmt.Fprintf(&b, "\tif (%s) return \"DIRECT\"; // passthrough\n", pacCondition("", "", prefix))
+		}
+	}
+	b.WriteString("\treturn proxy;\n}\n")
+	return []byte(b.String())
+}
+
+// pacCondition translates routing rule to PAC expression, and CIDR only matches ip literals without dns lookup like routeRule.match.
+func pacCondition(pattern string, port string, prefix netip.Prefix) string {
+	if port != "" {
+		return "glpPort(url) == " + jsString(port)
+	} else if prefix.IsValid() && prefix.Addr().Is4() {
+		mask := net.CIDRMask(prefix.Bits(), 32)
+		return fmt.Sprintf("glpIsIP(host) && isInNet(host, %s, %s)", jsString(prefix.Addr().String()), jsString(net.IP(mask).String()))
+	} else if prefix.IsValid() {
+		return fmt.Sprintf("host.indexOf(\":\") >= 0 && typeof isInNetEx == \"function\" && isInNetEx(host, %s)", jsString(prefix.String()))
+	} else if strings.HasPrefix(pattern, ".") {
+		return fmt.Sprintf("dnsDomainIs(host, %s) || host == %s", jsString(pattern), jsString(pattern[1:]))
+	}
+	return "shExpMatch(host, " + jsString(pattern) + ")"
+}
+
+func jsString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// isPACSource reports whether relay proxy from command line is a PAC file path or url instead of a proxy url.
+func isPACSource(relay string) bool {
+	if u, err := url.Parse(relay); err == nil && u.Path != "" {
+		relay = u.Path
+	}
+	return strings.HasSuffix(strings.ToLower(relay), ".pac") || strings.EqualFold(path.Base(relay), "wpad.dat")
+}
+
+// loadPAC reads PAC script from http(s) url, file url or local path.
+func loadPAC(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{Proxy: nil}}
+		res, err := client.Get(source)
+		if err != nil {
+			return nil, fmt.Errorf("client.Get: %w", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, errors.New("proxy: unexpected PAC status: " + res.Status)
+		}
+		return io.ReadAll(res.Body)
+	}
+
+	fpath, err := fsutil.ExpandHomeDir(strings.TrimPrefix(source, "file://"))
+	if err != nil {
+		return nil, fmt.Errorf("fsutil.ExpandHomeDir: %w", err)
+	}
+	return os.ReadFile(fpath)
+}
+
+// pacResolver chooses upstream for each destination by FindProxyForURL of PAC script.
+// The script is evaluated on every request without caching, because results may depend on time and dns.
+type pacResolver struct {
+	program  *goja.Program
+	runtimes sync.Pool // *pacRuntime, since goja.Runtime is not goroutine-safe
+
+	direct    *upstream
+	tlsConfig *tls.Config
+	http2     bool
+	upstreams map[string]*upstream // PAC entry like 'PROXY 10.0.0.1:3128' => upstream
+	mu        sync.Mutex
+}
+
+type pacRuntime struct {
+	vm   *goja.Runtime
+	find goja.Callable
+}
+
+func newPACResolver(source string, direct *upstream, tlsConfig *tls.Config, http2 bool) (*pacResolver, error) {
+	script, err := loadPAC(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &pacResolver{direct: direct, tlsConfig: tlsConfig, http2: http2, upstreams: make(map[string]*upstream)}
+	if p.program, err = goja.Compile(source, string(script), false); err != nil {
+		return nil, fmt.Errorf("goja.Compile: %w", err)
+	}
+	rt, err := p.newRuntime()
+	if err != nil {
+		return nil, err
+	}
+	p.runtimes.Put(rt)
+	return p, nil
+}
+
+func (p *pacResolver) newRuntime() (*pacRuntime, error) {
+	vm := goja.New()
+	for name, fn := range pacNatives {
+		vm.Set(name, fn)
+	}
+	if _, err := vm.RunProgram(pacPreludeProgram); err != nil {
+		return nil, fmt.Errorf("vm.RunProgram: %w", err)
+	}
+	if _, err := vm.RunProgram(p.program); err != nil {
+		return nil, fmt.Errorf("vm.RunProgram: %w", err)
+	}
+	find, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, errors.New("proxy: FindProxyForURL is not defined in PAC script")
+	}
+	return &pacRuntime{vm: vm, find: find}, nil
+}
+
+// findProxy calls FindProxyForURL(url, host) with a timeout against infinite loops in script.
+func (p *pacResolver) findProxy(rawURL string, host string) (string, error) {
+	rt, _ := p.runtimes.Get().(*pacRuntime)
+	if rt == nil {
+		var err error
+		if rt, err = p.newRuntime(); err != nil {
+			return "", err
+		}
+	}
+	timer := time.AfterFunc(pacEvalTimeout, func() { rt.vm.Interrupt("timeout") })
+	result, err := rt.find(goja.Undefined(), rt.vm.ToValue(rawURL), rt.vm.ToValue(host))
+	if !timer.Stop() {
+		rt.vm.ClearInterrupt()
+	}
+	p.runtimes.Put(rt)
+	if err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// route returns upstream of the first supported entry in PAC result, and falls back to direct like browsers if none is usable.
+// Url passed to script is stripped to 'scheme://host:port/' for both http and https, as chrome does for https.
+func (p *pacResolver) route(u *url.URL, port string) *upstream {
+	scheme := u.Scheme
+	if scheme == "" && port == "443" {
+		scheme = "https"
+	} else if scheme == "" {
+		scheme = "http"
+	}
+	host := u.Hostname()
+	result, err := p.findProxy(scheme+"://"+net.JoinHostPort(host, port)+"/", host)
+	if err != nil {
+		global.LOG.Errorf(context.Background(), "proxy: FindProxyForURL %s %s", u.Host, err.Error())
+		return p.direct
+	}
+	for _, entry := range strings.Split(result, ";") {
+		if up := p.upstream(strings.Fields(entry)); up != nil {
+			return up
+		}
+	}
+	global.LOG.Warnf(context.Background(), "proxy: no supported entry in FindProxyForURL result %q for %s", result, u.Host)
+	return p.direct
+}
+
+// upstream returns cached upstream for PAC entry fields like ['PROXY', 'host:port'], or nil if it is unsupported.
+func (p *pacResolver) upstream(fields []string) *upstream {
+	if len(fields) == 1 && strings.EqualFold(fields[0], "DIRECT") {
+		return p.direct
+	} else if len(fields) != 2 {
+		return nil
+	}
+	var scheme string
+	switch strings.ToUpper(fields[0]) {
+	case "PROXY", "HTTP":
+		scheme = "http"
+	case "HTTPS":
+		scheme = "https"
+	case "SOCKS", "SOCKS5":
+		scheme = "socks5"
+	default:
+		return nil // SOCKS4 and QUIC are not supported
+	}
+	name := strings.ToUpper(fields[0]) + " " + fields[1]
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if up, ok := p.upstreams[name]; ok {
+		return up
+	}
+	up := &upstream{name: name}
+	var err error
+	if up.dialer, up.transport, err = parseProxy(scheme+"://"+fields[1], p.tlsConfig.Clone(), p.http2); err != nil {
+		global.LOG.Errorf(context.Background(), "proxy: invalid PAC entry %q %s", name, err.Error())
+		return nil
+	}
+	p.upstreams[name] = up
+	return up
+}
+
+// pacNatives are PAC helper functions that need dns or network interfaces, and the others are implemented in pacPrelude.
+var pacNatives = map[string]any{
+	"dnsResolve": func(host string) any {
+		if addrs := pacLookup(host, "ip4"); len(addrs) > 0 {
+			return addrs[0].String()
+		}
+		return nil
+	},
+	"dnsResolveEx": func(host string) string {
+		return joinAddrs(pacLookup(host, "ip"))
+	},
+	"isResolvable": func(host string) bool {
+		return len(pacLookup(host, "ip4")) > 0
+	},
+	"isResolvableEx": func(host string) bool {
+		return len(pacLookup(host, "ip")) > 0
+	},
+	"myIpAddress": func() string {
+		for _, addr := range localAddrs() {
+			if addr.Is4() {
+				return addr.String()
+			}
+		}
+		return "127.0.0.1"
+	},
+	"myIpAddressEx": func() string {
+		return joinAddrs(localAddrs())
+	},
+	"isInNetEx": func(host string, cidr string) bool {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return false
+		}
+		addrs := pacLookup(host, "ip")
+		for _, addr := range addrs {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	},
+	"shExpMatch": func(str string, pattern string) bool {
+		return matchShExp(str, pattern)
+	},
+	"alert": func(msg string) {
+		global.LOG.Debugf(context.Background(), "proxy: PAC alert %s", msg)
+	},
+}
+
+// pacLookup resolves host to addresses of network 'ip4' or 'ip', and ip literal is returned as is.
+func pacLookup(host string, network string) []netip.Addr {
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return []netip.Addr{addr.Unmap()}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pacDNSTimeout)
+	defer cancel()
+	addrs, _ := net.DefaultResolver.LookupNetIP(ctx, network, host)
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs
+}
+
+// localAddrs returns addresses of local interfaces, and the one used for default route comes first.
+func localAddrs() (result []netip.Addr) {
+	if conn, err := net.Dial("udp", "8.8.8.8:53"); err == nil { // no packet is sent for udp dial
+		if addr, err := netip.ParseAddrPort(conn.LocalAddr().String()); err == nil {
+			result = append(result, addr.Addr().Unmap())
+		}
+		conn.Close()
+	}
+	ifAddrs, _ := net.InterfaceAddrs()
+	for _, ifAddr := range ifAddrs {
+		if ipNet, ok := ifAddr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			if addr, ok := netip.AddrFromSlice(ipNet.IP); ok && (len(result) == 0 || result[0] != addr.Unmap()) {
+				result = append(result, addr.Unmap())
+			}
+		}
+	}
+	return result
+}
+
+func joinAddrs(addrs []netip.Addr) string {
+	items := make([]string, len(addrs))
+	for i, addr := range addrs {
+		items[i] = addr.String()
+	}
+	return strings.Join(items, ";")
+}
+
+// matchShExp matches str against shell expression with '*' and '?', and unlike path.Match '*' also matches '/'.
+func matchShExp(str string, pattern string) bool {
+	var si, pi, starP, starS = 0, 0, -1, 0
+	for si < len(str) {
+		if pi < len(pattern) && (pattern[pi] == '?' || pattern[pi] == str[si]) {
+			si, pi = si+1, pi+1
+		} else if pi < len(pattern) && pattern[pi] == '*' {
+			starP, starS = pi, si
+			pi++
+		} else if starP >= 0 {
+			starS++
+			si, pi = starS, starP+1
+		} else {
+			return false
+		}
+	}
+	for pi < len(pattern) && pattern[pi] == '*' {
+		pi++
+	}
+	return pi == len(pattern)
+}
+
+var pacPreludeProgram = goja.MustCompile("prelude.js", pacPrelude, false)
+
+// pacPrelude implements the standard PAC helper functions without dns lookup.
+// Date and time functions accept an optional trailing 'GMT' argument.
+const pacPrelude = `
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length && host.substring(host.length - domain.length) == domain;
+}
+
+function dnsDomainLevels(host) {
+	return host.split(".").length - 1;
+}
+
+function isPlainHostName(host) {
+	return host.search(/[.:]/) == -1;
+}
+
+function localHostOrDomainIs(host, hostdom) {
+	return host == hostdom || hostdom.lastIndexOf(host + ".", 0) == 0;
+}
+
+function convert_addr(ipchars) {
+	var bytes = ipchars.split(".");
+	return (((bytes[0] & 0xff) << 24) | ((bytes[1] & 0xff) << 16) | ((bytes[2] & 0xff) << 8) | (bytes[3] & 0xff)) >>> 0;
+}
+
+function isInNet(ipaddr, pattern, maskstr) {
+	if (!/^\d+\.\d+\.\d+\.\d+$/.test(ipaddr)) {
+		ipaddr = dnsResolve(ipaddr);
+		if (ipaddr == null) return false;
+	}
+	var mask = convert_addr(maskstr);
+	return ((convert_addr(ipaddr) & mask) >>> 0) == ((convert_addr(pattern) & mask) >>> 0);
+}
+
+var glpDays = ["SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"];
+var glpMonths = ["JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"];
+
+function glpNow(args) {
+	var list = Array.prototype.slice.call(args), now = new Date();
+	var gmt = list.length > 0 && list[list.length - 1] == "GMT";
+	if (gmt) list.pop();
+	return {
+		list: list,
+		day: gmt ? now.getUTCDay() : now.getDay(),
+		date: gmt ? now.getUTCDate() : now.getDate(),
+		month: gmt ? now.getUTCMonth() : now.getMonth(),
+		year: gmt ? now.getUTCFullYear() : now.getFullYear(),
+		secs: gmt ? now.getUTCHours() * 3600 + now.getUTCMinutes() * 60 + now.getUTCSeconds() : now.getHours() * 3600 + now.getMinutes() * 60 + now.getSeconds()
+	};
+}
+
+function glpInRange(cur, start, end) {
+	return start <= end ? start <= cur && cur <= end : cur >= start || cur <= end;
+}
+
+function weekdayRange() {
+	var now = glpNow(arguments);
+	var d1 = glpDays.indexOf(now.list[0]), d2 = now.list.length > 1 ? glpDays.indexOf(now.list[1]) : d1;
+	return d1 >= 0 && d2 >= 0 && glpInRange(now.day, d1, d2);
+}
+
+function dateRange() {
+	var now = glpNow(arguments), list = now.list;
+	var parse = function(items) {
+		var t = {};
+		items.forEach(function(v) {
+			var m = glpMonths.indexOf(v);
+			if (m >= 0) t.month = m;
+			else if (Number(v) > 31) t.year = Number(v);
+			else t.date = Number(v);
+		});
+		return t;
+	};
+	var start, end;
+	if (list.length == 1) {
+		start = end = parse(list);
+	} else if (list.length % 2 == 0 && list.length <= 6) {
+		start = parse(list.slice(0, list.length / 2));
+		end = parse(list.slice(list.length / 2));
+	} else {
+		return false;
+	}
+	var value = function(t, ref) {
+		return (ref.year !== undefined ? t.year * 10000 : 0) + (ref.month !== undefined ? t.month * 100 : 0) + (ref.date !== undefined ? t.date : 0);
+	};
+	return glpInRange(value(now, start), value(start, start), value(end, start));
+}
+
+function timeRange() {
+	var now = glpNow(arguments), l = now.list.map(Number), start, end;
+	if (l.length == 1) {
+		start = l[0] * 3600, end = start + 3599;
+	} else if (l.length == 2) {
+		start = l[0] * 3600, end = l[1] * 3600 - 1;
+	} else if (l.length == 4) {
+		start = l[0] * 3600 + l[1] * 60, end = l[2] * 3600 + l[3] * 60 + 59;
+	} else if (l.length == 6) {
+		start = l[0] * 3600 + l[1] * 60 + l[2], end = l[3] * 3600 + l[4] * 60 + l[5];
+	} else {
+		return false;
+	}
+	return glpInRange(now.secs, start, end);
+}
+`
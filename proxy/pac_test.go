@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchShExp(t *testing.T) {
+	tests := []struct {
+		str     string
+		pattern string
+		want    bool
+	}{
+		{"www.example.com", "*.example.com", true},
+		{"example.com", "*.example.com", false},
+		{"http://example.com/a/b", "http://*/b", true},
+		{"http://example.com/a/b", "http://*/a", false},
+		{"a1.example.com", "a?.example.com", true},
+		{"a12.example.com", "a?.example.com", false},
+		{"abcbcd", "a*bcd", true},
+		{"", "*", true},
+		{"", "?", false},
+		{"example.com", "", false},
+		{"example.com", "example.com**", true},
+	}
+	for _, tt := range tests {
+		if got := matchShExp(tt.str, tt.pattern); got != tt.want {
+			t.Errorf("matchShExp(%q, %q) = %t, want %t", tt.str, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+const testPACScript = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host)) return "DIRECT";
+	if (dnsDomainIs(host, ".corp.test")) return "PROXY corp:3128; DIRECT";
+	if (isInNet(host, "10.0.0.0", "255.0.0.0")) return "SOCKS5 10.0.0.1:1080";
+	if (shExpMatch(host, "*.h?.test")) return "HTTPS secure:443";
+	if (host == "old.test") return "SOCKS4 old:1080; QUIC old:443";
+	if (host == "error.test") throw new Error("broken script");
+	if (shExpMatch(url, "https://*:443/")) return "PROXY tls:3128";
+	return "PROXY default:3128";
+}
+`
+
+func newTestPACResolver(t *testing.T, script string) (*pacResolver, error) {
+	t.Helper()
+	fpath := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(fpath, []byte(script), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return newPACResolver(fpath, &upstream{name: routeDirect}, &tls.Config{}, false)
+}
+
+func TestPACRoute(t *testing.T) {
+	p, err := newTestPACResolver(t, testPACScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		scheme string
+		host   string
+		port   string
+		want   string
+	}{
+		{"http", "intranet", "80", routeDirect},
+		{"http", "www.corp.test", "80", "PROXY corp:3128"},
+		{"", "10.1.2.3", "22", "SOCKS5 10.0.0.1:1080"},
+		{"http", "www.h2.test", "80", "HTTPS secure:443"},
+		{"http", "www.h22.test", "80", "PROXY default:3128"},
+		{"http", "old.test", "80", routeDirect},
+		{"http", "error.test", "80", routeDirect},
+		{"https", "example.com", "443", "PROXY tls:3128"},
+		{"", "example.com", "443", "PROXY tls:3128"}, // CONNECT request without scheme
+		{"http", "example.com", "80", "PROXY default:3128"},
+	}
+	for _, tt := range tests {
+		u := &url.URL{Scheme: tt.scheme, Host: tt.host + ":" + tt.port}
+		if got := p.route(u, tt.port); got.name != tt.want {
+			t.Errorf("route(%s) = %s, want %s", u, got.name, tt.want)
+		}
+	}
+
+	u := &url.URL{Scheme: "http", Host: "example.com"}
+	if p.route(u, "80") != p.route(u, "80") {
+		t.Error("route() returns different upstream for the same PAC entry")
+	}
+	if got, err := p.findProxy("http://intranet/", "intranet"); err != nil || got != "DIRECT" {
+		t.Errorf("findProxy() = %q, %v, want DIRECT", got, err)
+	}
+}
+
+func TestNewPACResolver(t *testing.T) {
+	for name, script := range map[string]string{
+		"syntax error":       "function FindProxyForURL(url, host) {",
+		"missing function":   "function FindProxy(url, host) { return \"DIRECT\"; }",
+		"error at top level": "throw new Error(\"broken script\");",
+	} {
+		if _, err := newTestPACResolver(t, script); err == nil {
+			t.Errorf("%s: newPACResolver succeeded, want error", name)
+		}
+	}
+}
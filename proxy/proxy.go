@@ -1,80 +1,325 @@
 package proxy
 
 import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/whoisnian/glp/global"
 	xproxy "golang.org/x/net/proxy"
 )
 
-var directDialer = &net.Dialer{}
+var directDialer = &net.Dialer{KeepAlive: 30 * time.Second}
 
+// dialWithContext dials through d, and gives up waiting when ctx is done if d does not support context.
+func dialWithContext(ctx context.Context, d xproxy.Dialer, network string, addr string) (net.Conn, error) {
+	if cd, ok := d.(xproxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := d.Dial(network, addr)
+		ch <- result{conn, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// dialUpstream connects to addr by dialer within dial timeout, and gives up early if ctx is done.
+// The via is name of upstream or address of relay proxy in error message.
+func dialUpstream(ctx context.Context, dialer xproxy.Dialer, via string, addr string) (net.Conn, error) {
+	if global.CFG.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, global.CFG.DialTimeout)
+		defer cancel()
+	}
+	conn, err := dialWithContext(ctx, dialer, "tcp", addr)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("proxy: dial %s through %s timed out after %s: %w", addr, via, global.CFG.DialTimeout, err)
+	}
+	return conn, err
+}
+
+// handshakeContext completes tls handshake within tls timeout, and gives up early if ctx is done.
+func handshakeContext(ctx context.Context, conn *tls.Conn) error {
+	if global.CFG.TLSTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, global.CFG.TLSTimeout)
+		defer cancel()
+	}
+	err := conn.HandshakeContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("proxy: tls handshake timed out after %s: %w", global.CFG.TLSTimeout, err)
+	}
+	return err
+}
+
+// upstreamErrorStatus returns status code for client when upstream fails, 504 for timeout and 502 for others.
+func upstreamErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// httpProxy dials through http(s) proxy by CONNECT method.
+// Basic credentials in url are sent preemptively, and Digest or NTLM challenge in 407 response is answered on the same connection.
 type httpProxy struct {
-	addr string
-	tls  bool
-	hdr  http.Header
+	addr    string
+	tls     bool
+	user    string
+	pass    string
+	hasAuth bool
+	learned atomic.Value // string, auth scheme required by proxy in previous handshake
 }
 
 func newHttpProxy(url *url.URL) *httpProxy {
-	hdr := http.Header{}
-	if url.User != nil {
-		pass, _ := url.User.Password()
-		auth := url.User.Username() + ":" + pass
-		hdr = http.Header{"Proxy-Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(auth))}}
-	}
-	return &httpProxy{
+	p := &httpProxy{
 		addr: net.JoinHostPort(url.Hostname(), url.Port()),
 		tls:  url.Scheme == "https",
-		hdr:  hdr,
 	}
+	if url.User != nil {
+		p.user, p.hasAuth = url.User.Username(), true
+		p.pass, _ = url.User.Password()
+	}
+	return p
 }
 
 func (p *httpProxy) Dial(network, addr string) (conn net.Conn, err error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext tags errors with stage, as failures of relay proxy and its CONNECT target can not be told apart by type.
+func (p *httpProxy) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	conn, err = p.dialProxy(ctx)
+	if err != nil {
+		return nil, &stageError{stageProxy, err}
+	}
+	auth := &proxyAuthenticator{user: p.user, pass: p.pass, uri: addr}
+	authorization := ""
+	if scheme, _ := p.learned.Load().(string); p.hasAuth {
+		authorization = auth.initial(scheme)
+	}
+
+	for round := 0; ; round++ {
+		bufioConn := NewBufioConn(conn)
+		res, err := p.connect(ctx, bufioConn, addr, authorization)
+		if err != nil {
+			bufioConn.Close()
+			return nil, &stageError{stageProxy, err}
+		} else if res.StatusCode == http.StatusOK {
+			return bufioConn, nil
+		} else if res.StatusCode != http.StatusProxyAuthRequired || !p.hasAuth || round >= 3 {
+			bufioConn.Close()
+			return nil, connectStatusError(res)
+		}
+
+		if authorization, err = auth.respond(res.Header.Values("Proxy-Authenticate")); err != nil {
+			bufioConn.Close()
+			return nil, &stageError{stageProxy, err}
+		}
+		p.learned.Store(auth.scheme)
+		if res.Close && auth.scheme == "ntlm" && auth.step > 1 {
+			bufioConn.Close()
+			return nil, &stageError{stageProxy, errors.New("proxy: NTLM handshake requires keep-alive connection")}
+		} else if res.Close {
+			bufioConn.Close()
+			if conn, err = p.dialProxy(ctx); err != nil {
+				return nil, &stageError{stageProxy, err}
+			}
+		} else {
+			io.Copy(io.Discard, res.Body) // reuse connection for the next round
+			res.Body.Close()
+			conn = bufioConn
+		}
+	}
+}
+
+// connectStatusError reports unexpected CONNECT response, and gateway errors mean relay proxy failed to reach target.
+func connectStatusError(res *http.Response) error {
+	stage := stageProxy
+	if res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusServiceUnavailable || res.StatusCode == http.StatusGatewayTimeout {
+		stage = stageConnect
+	}
+	return &stageError{stage, errors.New("proxy: unexpected CONNECT status: " + res.Status)}
+}
+
+func (p *httpProxy) dialProxy(ctx context.Context) (net.Conn, error) {
+	if p.tls {
+		return (&tls.Dialer{NetDialer: directDialer}).DialContext(ctx, "tcp", p.addr)
+	}
+	return directDialer.DialContext(ctx, "tcp", p.addr)
+}
+
+// connect sends CONNECT request and reads its response, and gives up early if ctx is done.
+func (p *httpProxy) connect(ctx context.Context, conn *BufioConn, addr string, authorization string) (*http.Response, error) {
 	req := &http.Request{
 		Method: http.MethodConnect,
 		Proto:  "HTTP/1.1",
 		URL:    &url.URL{Opaque: addr},
 		Host:   addr,
-		Header: p.hdr,
+		Header: http.Header{},
 	}
-	if p.tls {
-		conn, err = tls.DialWithDialer(directDialer, "tcp", p.addr, nil)
-	} else {
-		conn, err = directDialer.Dial("tcp", p.addr)
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
 	}
-	if err != nil {
-		return nil, err
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	var res *http.Response
+	err := req.Write(conn)
+	if err == nil {
+		res, err = http.ReadResponse(conn.Reader(), req)
+	}
+	if !stop() {
+		return nil, ctx.Err()
 	}
+	return res, err
+}
 
-	bufioConn := NewBufioConn(conn)
-	req.Write(bufioConn)
+// proxyAuthenticator answers 407 challenges from http proxy during a single CONNECT handshake.
+// NTLM is preferred over Digest, and Basic is the last resort.
+type proxyAuthenticator struct {
+	user   string
+	pass   string
+	uri    string
+	scheme string // the last scheme sent: basic, digest or ntlm
+	step   int    // rounds of the last scheme sent
+}
 
-	res, err := http.ReadResponse(bufioConn.Reader(), req)
-	if err != nil {
-		return nil, err
-	} else if res.StatusCode != http.StatusOK {
-		return nil, errors.New("proxy: unexpected CONNECT status: " + res.Status)
+// initial returns Proxy-Authorization of the first request according to scheme learned from previous handshakes.
+func (a *proxyAuthenticator) initial(learned string) string {
+	switch learned {
+	case "ntlm":
+		a.scheme, a.step = "ntlm", 1
+		return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate())
+	case "digest":
+		return "" // nonce is unknown before challenge
+	}
+	a.scheme, a.step = "basic", 1
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.user+":"+a.pass))
+}
+
+func (a *proxyAuthenticator) respond(challenges []string) (string, error) {
+	offered := make(map[string]string) // scheme => params
+	for _, challenge := range challenges {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		offered[strings.ToLower(scheme)] = strings.TrimSpace(params)
+	}
+
+	if token, ok := offered["ntlm"]; ok {
+		if token == "" && a.scheme != "ntlm" {
+			a.scheme, a.step = "ntlm", 1
+			return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate()), nil
+		} else if token == "" || a.scheme != "ntlm" || a.step != 1 {
+			return "", errors.New("proxy: NTLM authentication failed")
+		}
+		msg, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return "", errors.New("proxy: invalid NTLM challenge: " + err.Error())
+		}
+		challenge, err := parseNTLMChallenge(msg)
+		if err != nil {
+			return "", err
+		}
+		a.step++
+		return "NTLM " + base64.StdEncoding.EncodeToString(ntlmAuthenticate(challenge, a.user, a.pass)), nil
+	} else if params, ok := offered["digest"]; ok {
+		challenge := parseAuthParams(params)
+		if a.scheme == "digest" && !strings.EqualFold(challenge["stale"], "true") {
+			return "", errors.New("proxy: Digest authentication failed")
+		}
+		a.scheme, a.step = "digest", a.step+1
+		return digestAuthorization(challenge, a.user, a.pass, http.MethodConnect, a.uri)
+	} else if _, ok := offered["basic"]; ok && a.scheme != "basic" {
+		a.scheme, a.step = "basic", 1
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.user+":"+a.pass)), nil
 	}
-	return bufioConn, nil
+	return "", errors.New("proxy: unsupported or failed proxy authentication: " + strings.Join(challenges, "; "))
 }
 
-func parseProxy(rawURL string) (xproxy.Dialer, *http.Transport, error) {
+// digestAuthorization computes Digest credentials for challenge with MD5 or SHA-256 algorithm and 'auth' qop.
+// https://www.rfc-editor.org/rfc/rfc7616#section-3.4
+func digestAuthorization(challenge map[string]string, user string, pass string, method string, uri string) (string, error) {
+	algorithm := cmp.Or(challenge["algorithm"], "MD5")
+	var hash func(string) string
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS")) {
+	case "MD5":
+		hash = md5Hex
+	case "SHA-256":
+		hash = func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}
+	default:
+		return "", errors.New("proxy: unsupported Digest algorithm: " + algorithm)
+	}
+
+	realm, nonce := challenge["realm"], challenge["nonce"]
+	cnonce := make([]byte, 16)
+	rand.Read(cnonce)
+	cnonceHex := hex.EncodeToString(cnonce)
+	ha1 := hash(user + ":" + realm + ":" + pass)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = hash(ha1 + ":" + nonce + ":" + cnonceHex)
+	}
+	ha2 := hash(method + ":" + uri)
+
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s`, quote(user), quote(realm), quote(nonce), quote(uri), algorithm)
+	if qop := challenge["qop"]; slices.Contains(splitList(qop), "auth") {
+		fmt.Fprintf(&b, `, qop=auth, nc=00000001, cnonce="%s", response="%s"`, cnonceHex, hash(ha1+":"+nonce+":00000001:"+cnonceHex+":auth:"+ha2))
+	} else if qop == "" {
+		fmt.Fprintf(&b, `, response="%s"`, hash(ha1+":"+nonce+":"+ha2))
+	} else {
+		return "", errors.New("proxy: unsupported Digest qop: " + qop)
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		fmt.Fprintf(&b, `, opaque="%s"`, quote(opaque))
+	}
+	return b.String(), nil
+}
+
+func parseProxy(rawURL string, tlsConfig *tls.Config, http2 bool) (xproxy.Dialer, *http.Transport, error) {
 	if rawURL == "" {
 		return directDialer, &http.Transport{
 			Proxy: nil, // http.DefaultTransport but without proxy
 			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
+				Timeout:   global.CFG.DialTimeout,
 				KeepAlive: 30 * time.Second,
 			}).DialContext,
-			ForceAttemptHTTP2:     false, // disable http2
+			TLSClientConfig:       tlsConfig,
+			ForceAttemptHTTP2:     http2,
 			MaxIdleConns:          100,
 			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
+			TLSHandshakeTimeout:   global.CFG.TLSTimeout,
 			ExpectContinueTimeout: 1 * time.Second,
 		}, nil
 	}
@@ -99,16 +344,31 @@ func parseProxy(rawURL string) (xproxy.Dialer, *http.Transport, error) {
 	} else {
 		return nil, nil, errors.New("proxy: unknown scheme: " + u.Scheme)
 	}
-	return dialer, &http.Transport{
+	transport := &http.Transport{
 		Proxy: http.ProxyURL(u), // http.DefaultTransport but fixed proxy
 		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
+			Timeout:   global.CFG.DialTimeout,
 			KeepAlive: 30 * time.Second,
 		}).DialContext,
-		ForceAttemptHTTP2:     false, // disable http2
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     http2,
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
+		TLSHandshakeTimeout:   global.CFG.TLSTimeout,
 		ExpectContinueTimeout: 1 * time.Second,
-	}, nil
+		OnProxyConnectResponse: func(ctx context.Context, proxyURL *url.URL, req *http.Request, res *http.Response) error {
+			if res.StatusCode != http.StatusOK {
+				return connectStatusError(res)
+			}
+			return nil
+		},
+	}
+	if p, ok := dialer.(*httpProxy); ok && p.hasAuth {
+		// tunnel plain http requests by CONNECT too, so that Digest or NTLM handshake is always done by dialer
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialUpstream(ctx, p, p.addr, addr)
+		}
+	}
+	return dialer, transport, nil
 }
@@ -0,0 +1,382 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+const testTarget = "example.com:443"
+
+type fakeReply struct {
+	status int
+	header http.Header
+	close  bool
+}
+
+// startFakeProxy serves CONNECT requests with replies from handle until 200, and returns its address and count of accepted connections.
+func startFakeProxy(t *testing.T, handle func(req *http.Request) fakeReply) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go serveFakeProxy(conn, handle)
+		}
+	}()
+	return ln.Addr().String(), accepted
+}
+
+func serveFakeProxy(conn net.Conn, handle func(req *http.Request) fakeReply) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		reply := handle(req)
+		var b strings.Builder
+		fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", reply.status, http.StatusText(reply.status))
+		reply.header.Write(&b)
+		if reply.status == http.StatusOK {
+			b.WriteString("\r\n")
+			conn.Write([]byte(b.String()))
+			io.Copy(io.Discard, conn) // tunnel is established, wait for client to close
+			return
+		}
+		if reply.close {
+			b.WriteString("Connection: close\r\n")
+		}
+		b.WriteString("Content-Length: 7\r\n\r\ndenied\n")
+		if _, err = conn.Write([]byte(b.String())); err != nil || reply.close {
+			return
+		}
+	}
+}
+
+func dialFakeProxy(t *testing.T, p xproxy.ContextDialer) (net.Conn, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := p.DialContext(ctx, "tcp", testTarget)
+	if conn != nil {
+		conn.Close()
+	}
+	return conn, err
+}
+
+func newTestHttpProxy(addr string, user string, pass string) *httpProxy {
+	return newHttpProxy(&url.URL{Scheme: "http", Host: addr, User: url.UserPassword(user, pass)})
+}
+
+// digestReference computes the expected Digest response of credentials in params as a proxy server.
+// https://www.rfc-editor.org/rfc/rfc7616#section-3.4.1
+func digestReference(params map[string]string, pass string, method string) string {
+	newHash := md5.New
+	algorithm := strings.ToUpper(params["algorithm"])
+	if strings.HasPrefix(algorithm, "SHA-256") {
+		newHash = sha256.New
+	}
+	h := func(s string) string {
+		hh := newHash()
+		hh.Write([]byte(s))
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+	ha1 := h(params["username"] + ":" + params["realm"] + ":" + pass)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + params["nonce"] + ":" + params["cnonce"])
+	}
+	ha2 := h(method + ":" + params["uri"])
+	if params["qop"] == "" {
+		return h(ha1 + ":" + params["nonce"] + ":" + ha2)
+	}
+	return h(ha1 + ":" + params["nonce"] + ":" + params["nc"] + ":" + params["cnonce"] + ":" + params["qop"] + ":" + ha2)
+}
+
+// https://www.rfc-editor.org/rfc/rfc7616#section-3.9.1
+func TestDigestReference(t *testing.T) {
+	params := map[string]string{
+		"username": "Mufasa",
+		"realm":    "http-auth@example.org",
+		"uri":      "/dir/index.html",
+		"qop":      "auth",
+		"nc":       "00000001",
+		"nonce":    "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		"cnonce":   "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+	}
+	for algorithm, want := range map[string]string{
+		"MD5":     "8ca523f5e9506fed4657c9700eebdbec",
+		"SHA-256": "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+	} {
+		params["algorithm"] = algorithm
+		if got := digestReference(params, "Circle of Life", "GET"); got != want {
+			t.Errorf("digestReference(%s) = %s, want %s", algorithm, got, want)
+		}
+	}
+}
+
+func TestHttpProxyDigest(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		qop       string
+		stale     bool
+		close     bool
+		dials     int32
+	}{
+		{"MD5", "auth", false, false, 1},
+		{"MD5", "", false, false, 1},
+		{"MD5", "auth", false, true, 2},
+		{"MD5", "auth", true, false, 1},
+		{"MD5", "auth", true, true, 3},
+		{"MD5-sess", "auth", false, false, 1},
+		{"SHA-256", "auth", false, false, 1},
+		{"SHA-256", "auth,auth-int", false, true, 2},
+		{"SHA-256-sess", "auth", true, false, 1},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s/qop=%s/stale=%t/close=%t", tt.algorithm, tt.qop, tt.stale, tt.close)
+		t.Run(name, func(t *testing.T) {
+			nonces := []string{"bm9uY2Ux", "bm9uY2Uy"}
+			if !tt.stale {
+				nonces = nonces[:1]
+			}
+			challenge := func(nonce string, stale bool) fakeReply {
+				value := fmt.Sprintf(`Digest realm="glp test", nonce="%s", algorithm=%s, opaque="b3BhcXVl", stale=%t`, nonce, tt.algorithm, stale)
+				if tt.qop != "" {
+					value += fmt.Sprintf(`, qop="%s"`, tt.qop)
+				}
+				return fakeReply{http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {value}}, tt.close}
+			}
+			var failure atomic.Value
+			addr, accepted := startFakeProxy(t, func(req *http.Request) fakeReply {
+				scheme, credentials, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+				if scheme != "Digest" {
+					return challenge(nonces[0], false)
+				}
+				params := parseAuthParams(credentials)
+				if params["nonce"] != nonces[len(nonces)-1] {
+					return challenge(nonces[len(nonces)-1], true)
+				}
+				want := map[string]string{"username": "alice", "realm": "glp test", "uri": testTarget, "algorithm": tt.algorithm, "opaque": "b3BhcXVl"}
+				if tt.qop != "" {
+					want["qop"], want["nc"] = "auth", "00000001"
+				}
+				for key, value := range want {
+					if params[key] != value {
+						failure.Store(fmt.Sprintf("%s = %q, want %q", key, params[key], value))
+						return fakeReply{status: http.StatusForbidden}
+					}
+				}
+				if expected := digestReference(params, "p@ss w0rd", http.MethodConnect); params["response"] != expected {
+					failure.Store(fmt.Sprintf("response = %s, want %s", params["response"], expected))
+					return fakeReply{status: http.StatusForbidden}
+				}
+				return fakeReply{status: http.StatusOK}
+			})
+
+			if _, err := dialFakeProxy(t, newTestHttpProxy(addr, "alice", "p@ss w0rd")); err != nil {
+				t.Fatalf("DialContext: %v (%v)", err, failure.Load())
+			}
+			if n := accepted.Load(); n != tt.dials {
+				t.Errorf("proxy accepted %d connections, want %d", n, tt.dials)
+			}
+		})
+	}
+}
+
+func TestHttpProxyDigestFailed(t *testing.T) {
+	addr, _ := startFakeProxy(t, func(req *http.Request) fakeReply {
+		return fakeReply{http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Digest realm="glp test", nonce="bm9uY2Ux", qop="auth"`}}, false}
+	})
+	if _, err := dialFakeProxy(t, newTestHttpProxy(addr, "alice", "wrong")); err == nil || !strings.Contains(err.Error(), "Digest authentication failed") {
+		t.Fatalf("DialContext error = %v, want Digest authentication failed", err)
+	}
+}
+
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-nlmp/946f54bd-76b5-4b18-ace8-6e8c992d5847
+var ntlmTestTargetInfo = mustDecodeHex("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+
+func TestNTLMv2Vectors(t *testing.T) {
+	key := ntowfV2("User", "Password", "Domain")
+	if got := hex.EncodeToString(key); got != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Errorf("ntowfV2 = %s", got)
+	}
+	serverChallenge, clientChallenge := mustDecodeHex("0123456789abcdef"), mustDecodeHex("aaaaaaaaaaaaaaaa")
+	ntResponse, lmProof := ntlmV2Response(key, serverChallenge, clientChallenge, make([]byte, 8), ntlmTestTargetInfo)
+	if got := hex.EncodeToString(ntResponse[:16]); got != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("NTProofStr = %s", got)
+	}
+	if got := hex.EncodeToString(lmProof); got != "86c35097ac9cec102554764a57cccc19" {
+		t.Errorf("LMv2 proof = %s", got)
+	}
+}
+
+// ntlmTestChallenge builds CHALLENGE_MESSAGE with target info, and MsvAvTimestamp is prepended if timestamp is not nil.
+func ntlmTestChallenge(serverChallenge []byte, timestamp []byte) []byte {
+	targetInfo := ntlmTestTargetInfo
+	if timestamp != nil {
+		targetInfo = append(append([]byte{ntlmAvTimestamp, 0, 8, 0}, timestamp...), targetInfo...)
+	}
+	msg := make([]byte, 48, 48+len(targetInfo))
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[16:], 48) // empty target name
+	binary.LittleEndian.PutUint32(msg[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateExtended)
+	copy(msg[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	return append(msg, targetInfo...)
+}
+
+// verifyNTLMAuthenticate checks AUTHENTICATE_MESSAGE against challenge as a proxy server.
+func verifyNTLMAuthenticate(msg []byte, serverChallenge []byte, timestamp []byte, user string, domain string, password string) error {
+	if len(msg) < 64 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		return fmt.Errorf("invalid AUTHENTICATE_MESSAGE %x", msg)
+	}
+	field := func(i int) []byte {
+		length, offset := int(binary.LittleEndian.Uint16(msg[12+8*i:])), int(binary.LittleEndian.Uint32(msg[16+8*i:]))
+		if offset+length > len(msg) {
+			return nil
+		}
+		return msg[offset : offset+length]
+	}
+	decode := func(b []byte) string {
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(u))
+	}
+	lmResponse, ntResponse := field(0), field(1)
+	if got := decode(field(2)); got != domain {
+		return fmt.Errorf("domain = %q, want %q", got, domain)
+	} else if got = decode(field(3)); got != user {
+		return fmt.Errorf("user = %q, want %q", got, user)
+	} else if len(ntResponse) < 48 || len(lmResponse) != 24 {
+		return fmt.Errorf("invalid response length %d and %d", len(ntResponse), len(lmResponse))
+	}
+
+	key := ntowfV2(user, password, domain)
+	mac := func(data ...[]byte) []byte {
+		var h hash.Hash = hmac.New(md5.New, key)
+		for _, d := range data {
+			h.Write(d)
+		}
+		return h.Sum(nil)
+	}
+	temp, clientChallenge := ntResponse[16:], ntResponse[32:40]
+	if !bytes.Equal(ntResponse[:16], mac(serverChallenge, temp)) {
+		return fmt.Errorf("invalid NTProofStr %x", ntResponse[:16])
+	} else if !bytes.Equal(temp[:8], []byte{1, 1, 0, 0, 0, 0, 0, 0}) || !bytes.Contains(temp, ntlmTestTargetInfo) {
+		return fmt.Errorf("invalid NTLMv2 client challenge %x", temp)
+	}
+	if timestamp != nil {
+		if !bytes.Equal(temp[8:16], timestamp) {
+			return fmt.Errorf("timestamp = %x, want %x", temp[8:16], timestamp)
+		} else if !bytes.Equal(lmResponse, make([]byte, 24)) {
+			return fmt.Errorf("LMv2 response = %x, want zero", lmResponse)
+		}
+	} else if !bytes.Equal(lmResponse, append(mac(serverChallenge, clientChallenge), clientChallenge...)) {
+		return fmt.Errorf("invalid LMv2 response %x", lmResponse)
+	}
+	return nil
+}
+
+func TestHttpProxyNTLM(t *testing.T) {
+	tests := []struct {
+		name           string
+		username       string
+		timestamp      []byte
+		closeInitial   bool
+		closeChallenge bool
+		dials          int32
+		wantErr        string
+	}{
+		{"keep-alive", `Domain\User`, nil, false, false, 1, ""},
+		{"timestamp", `Domain\User`, mustDecodeHex("0090d336b734c301"), false, false, 1, ""},
+		{"no domain", "User", nil, false, false, 1, ""},
+		{"close initial", `Domain\User`, nil, true, false, 2, ""},
+		{"close challenge", `Domain\User`, nil, false, true, 1, "NTLM handshake requires keep-alive connection"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain, user, ok := strings.Cut(tt.username, `\`)
+			if !ok {
+				domain, user = "", tt.username
+			}
+			serverChallenge := mustDecodeHex("0123456789abcdef")
+			var failure atomic.Value
+			var negotiated atomic.Int32
+			addr, accepted := startFakeProxy(t, func(req *http.Request) fakeReply {
+				scheme, token, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+				msg, _ := base64.StdEncoding.DecodeString(token)
+				if scheme != "NTLM" {
+					return fakeReply{http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {"NTLM"}}, tt.closeInitial}
+				} else if len(msg) >= 12 && binary.LittleEndian.Uint32(msg[8:]) == 1 {
+					negotiated.Add(1)
+					challenge := "NTLM " + base64.StdEncoding.EncodeToString(ntlmTestChallenge(serverChallenge, tt.timestamp))
+					return fakeReply{http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {challenge}}, tt.closeChallenge}
+				} else if err := verifyNTLMAuthenticate(msg, serverChallenge, tt.timestamp, user, domain, "Password"); err != nil {
+					failure.Store(err.Error())
+					return fakeReply{status: http.StatusForbidden}
+				}
+				return fakeReply{status: http.StatusOK}
+			})
+
+			p := newTestHttpProxy(addr, tt.username, "Password")
+			_, err := dialFakeProxy(t, p)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("DialContext error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("DialContext: %v (%v)", err, failure.Load())
+			}
+			if n := accepted.Load(); n != tt.dials {
+				t.Errorf("proxy accepted %d connections, want %d", n, tt.dials)
+			}
+
+			// the second handshake starts with NEGOTIATE_MESSAGE learned from the first one
+			if _, err = dialFakeProxy(t, p); err != nil {
+				t.Fatalf("DialContext again: %v (%v)", err, failure.Load())
+			}
+			if n := accepted.Load(); n != tt.dials+1 {
+				t.Errorf("proxy accepted %d connections, want %d", n, tt.dials+1)
+			} else if n := negotiated.Load(); n != 2 {
+				t.Errorf("proxy received %d NEGOTIATE_MESSAGE, want 2", n)
+			}
+		})
+	}
+}
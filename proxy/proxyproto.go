@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// https://www.haproxy.org/download/3.1/doc/proxy-protocol.txt
+const (
+	ProxyProtoOff      = "off"
+	ProxyProtoOptional = "optional"
+	ProxyProtoRequired = "required"
+
+	proxyProtoV1MaxLen  = 107
+	proxyProtoV2HdrLen  = 16
+	proxyProtoTimeout   = 10 * time.Second
+	proxyProtoV2CmdLoc  = 0x0
+	proxyProtoV2CmdProx = 0x1
+	proxyProtoV2TCP4    = 0x11
+	proxyProtoV2TCP6    = 0x21
+)
+
+var (
+	proxyProtoV1Prefix = []byte("PROXY ")
+	proxyProtoV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyProtoConn replaces the addresses of conn with the ones in PROXY protocol header sent by load balancer.
+// The br is not pooled, as other goroutines may still be reading from it when connection is closed.
+type proxyProtoConn struct {
+	net.Conn
+	br     *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) { return c.br.Read(b) }
+func (c *proxyProtoConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxyProtoConn) LocalAddr() net.Addr        { return c.local }
+
+// unwrapConn returns the accepted connection before PROXY protocol header.
+func unwrapConn(conn net.Conn) net.Conn {
+	if c, ok := conn.(*proxyProtoConn); ok {
+		return c.Conn
+	}
+	return conn
+}
+
+func validProxyProtoMode(mode string) bool {
+	return mode == ProxyProtoOff || mode == ProxyProtoOptional || mode == ProxyProtoRequired
+}
+
+// acceptProxyProto reads PROXY protocol header from conn according to mode.
+// In optional mode, connections without header are served as is, and the first bytes of them are peeked incrementally,
+// because clients like socks5 may send fewer bytes than the v2 signature and wait for server.
+func acceptProxyProto(conn net.Conn, mode string) (net.Conn, error) {
+	if mode == ProxyProtoOff {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(proxyProtoTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	pc := &proxyProtoConn{Conn: conn, br: bufio.NewReaderSize(conn, defaultBufSize), remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+	var err error
+	if mode == ProxyProtoRequired || hasProxyProtoPrefix(pc.br) {
+		err = pc.readHeader()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+func hasProxyProtoPrefix(br *bufio.Reader) bool {
+	first, err := br.Peek(1)
+	if err != nil {
+		return false
+	}
+	var prefix []byte
+	if first[0] == proxyProtoV1Prefix[0] {
+		prefix = proxyProtoV1Prefix
+	} else if first[0] == proxyProtoV2Sig[0] {
+		prefix = proxyProtoV2Sig
+	} else {
+		return false
+	}
+	// both http request line and tls record are longer than the prefix, so peek will not block forever
+	data, err := br.Peek(len(prefix))
+	return err == nil && bytes.Equal(data, prefix)
+}
+
+func (c *proxyProtoConn) readHeader() error {
+	data, err := c.br.Peek(len(proxyProtoV1Prefix))
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, proxyProtoV1Prefix) {
+		return c.readHeaderV1()
+	}
+	return c.readHeaderV2()
+}
+
+// readHeaderV1 parses human-readable header like 'PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n'.
+func (c *proxyProtoConn) readHeaderV1() error {
+	line, err := c.br.ReadSlice('\n')
+	if err != nil || len(line) > proxyProtoV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("proxy: invalid PROXY protocol v1 header")
+	}
+	fields := strings.Fields(string(line[len(proxyProtoV1Prefix) : len(line)-2]))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil
+	} else if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return errors.New("proxy: invalid PROXY protocol v1 header")
+	}
+	src, err1 := netip.ParseAddr(fields[1])
+	dst, err2 := netip.ParseAddr(fields[2])
+	srcPort, err3 := strconv.ParseUint(fields[3], 10, 16)
+	dstPort, err4 := strconv.ParseUint(fields[4], 10, 16)
+	if err = errors.Join(err1, err2, err3, err4); err != nil {
+		return errors.New("proxy: invalid PROXY protocol v1 header: " + err.Error())
+	}
+	c.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(srcPort)))
+	c.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, uint16(dstPort)))
+	return nil
+}
+
+// readHeaderV2 parses binary header with 12 bytes signature, version and command, family, length and addresses.
+func (c *proxyProtoConn) readHeaderV2() error {
+	var hdr [proxyProtoV2HdrLen]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	} else if !bytes.Equal(hdr[:12], proxyProtoV2Sig) || hdr[12]>>4 != 0x2 {
+		return errors.New("proxy: invalid PROXY protocol v2 header")
+	}
+	cmd, family, length := hdr[12]&0x0f, hdr[13], int(binary.BigEndian.Uint16(hdr[14:]))
+
+	var addrLen int
+	if cmd == proxyProtoV2CmdProx && family == proxyProtoV2TCP4 {
+		addrLen = 12
+	} else if cmd == proxyProtoV2CmdProx && family == proxyProtoV2TCP6 {
+		addrLen = 36
+	} else if cmd != proxyProtoV2CmdLoc && cmd != proxyProtoV2CmdProx {
+		return errors.New("proxy: invalid PROXY protocol v2 command")
+	}
+	if length < addrLen {
+		return errors.New("proxy: invalid PROXY protocol v2 length")
+	}
+	var addrs [36]byte
+	if _, err := io.ReadFull(c.br, addrs[:addrLen]); err != nil {
+		return err
+	}
+	if _, err := c.br.Discard(length - addrLen); err != nil { // skip TLVs
+		return err
+	}
+
+	if addrLen == 12 {
+		c.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte(addrs[0:4])), binary.BigEndian.Uint16(addrs[8:10])))
+		c.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte(addrs[4:8])), binary.BigEndian.Uint16(addrs[10:12])))
+	} else if addrLen == 36 {
+		c.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.AddrFrom16([16]byte(addrs[0:16])), binary.BigEndian.Uint16(addrs[32:34])))
+		c.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.AddrFrom16([16]byte(addrs[16:32])), binary.BigEndian.Uint16(addrs[34:36])))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+)
+
+// https://www.haproxy.org/download/3.1/doc/proxy-protocol.txt
+func TestAcceptProxyProto(t *testing.T) {
+	const payload = "GET / HTTP/1.1\r\n\r\n"
+	v2Header := func(cmd byte, family byte, addrs string, tlvs string) string {
+		data := mustDecodeHex(addrs + tlvs)
+		return string(proxyProtoV2Sig) + string([]byte{0x20 | cmd, family, byte(len(data) >> 8), byte(len(data))}) + string(data)
+	}
+	tests := []struct {
+		name   string
+		mode   string
+		header string
+		remote string // empty means the address of accepted connection
+		local  string
+		fail   bool
+	}{
+		{"v1 tcp4", ProxyProtoRequired, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", "192.168.0.1:56324", "192.168.0.11:443", false},
+		{"v1 tcp6", ProxyProtoOptional, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", "[2001:db8::2]:443", false},
+		{"v1 unknown", ProxyProtoRequired, "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", "", false},
+		{"v2 tcp4", ProxyProtoRequired, v2Header(proxyProtoV2CmdProx, proxyProtoV2TCP4, "c0a80001c0a8000bdc0401bb", ""), "192.168.0.1:56324", "192.168.0.11:443", false},
+		{"v2 tcp4 with tlv", ProxyProtoOptional, v2Header(proxyProtoV2CmdProx, proxyProtoV2TCP4, "c0a80001c0a8000bdc0401bb", "0300045c17ec4d"), "192.168.0.1:56324", "192.168.0.11:443", false},
+		{"v2 tcp6", ProxyProtoRequired, v2Header(proxyProtoV2CmdProx, proxyProtoV2TCP6, "20010db800000000000000000000000120010db8000000000000000000000002dc0401bb", ""), "[2001:db8::1]:56324", "[2001:db8::2]:443", false},
+		{"v2 local", ProxyProtoRequired, v2Header(proxyProtoV2CmdLoc, 0, "", ""), "", "", false},
+		{"optional without header", ProxyProtoOptional, "", "", "", false},
+		{"off with header", ProxyProtoOff, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", "", "", false},
+		{"required without header", ProxyProtoRequired, "", "", "", true},
+		{"v1 invalid address", ProxyProtoRequired, "PROXY TCP4 192.168.0.1 example.com 56324 443\r\n", "", "", true},
+		{"v1 invalid port", ProxyProtoRequired, "PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n", "", "", true},
+		{"v1 missing crlf", ProxyProtoRequired, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n", "", "", true},
+		{"v2 short length", ProxyProtoRequired, v2Header(proxyProtoV2CmdProx, proxyProtoV2TCP4, "c0a80001", ""), "", "", true},
+		{"v2 invalid command", ProxyProtoRequired, v2Header(0x2, proxyProtoV2TCP4, "c0a80001c0a8000bdc0401bb", ""), "", "", true},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			io.WriteString(client, tt.header+payload)
+			client.Close()
+		}()
+		conn, err := acceptProxyProto(server, tt.mode)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: acceptProxyProto succeeded, want error", tt.name)
+			}
+			server.Close()
+			continue
+		} else if err != nil {
+			t.Errorf("%s: acceptProxyProto: %v", tt.name, err)
+			server.Close()
+			continue
+		}
+
+		wantRemote, wantLocal := tt.remote, tt.local
+		if wantRemote == "" {
+			wantRemote, wantLocal = server.RemoteAddr().String(), server.LocalAddr().String()
+		}
+		if got := conn.RemoteAddr().String(); got != wantRemote {
+			t.Errorf("%s: RemoteAddr() = %s, want %s", tt.name, got, wantRemote)
+		}
+		if got := conn.LocalAddr().String(); got != wantLocal {
+			t.Errorf("%s: LocalAddr() = %s, want %s", tt.name, got, wantLocal)
+		}
+		want := payload
+		if tt.mode == ProxyProtoOff {
+			want = tt.header + payload
+		}
+		if data, _ := io.ReadAll(conn); string(data) != want {
+			t.Errorf("%s: remaining data = %q, want %q", tt.name, data, want)
+		}
+		conn.Close()
+	}
+}
+
+func TestXForwardedFor(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		io.WriteString(client, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")
+		client.Close()
+	}()
+	conn, err := acceptProxyProto(server, ProxyProtoRequired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	setXForwarded(req)
+	if got := req.Header.Get("X-Forwarded-For"); got != "10.0.0.1, 192.168.0.1" {
+		t.Errorf("X-Forwarded-For of http/1 request = %q", got)
+	} else if got = req.Header.Get("X-Forwarded-Proto"); got != "http" {
+		t.Errorf("X-Forwarded-Proto of http/1 request = %q", got)
+	}
+
+	s := &Server{}
+	if err = s.setupH2(); err != nil {
+		t.Fatal(err)
+	}
+	in := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	in.RemoteAddr, in.TLS = conn.RemoteAddr().String(), &tls.ConnectionState{}
+	in.Header.Set("X-Forwarded-For", "10.0.0.1")
+	out := in.Clone(in.Context())
+	out.Header.Del("X-Forwarded-For") // removed by ReverseProxy before Rewrite
+	s.h2Proxy.Rewrite(&httputil.ProxyRequest{In: in, Out: out})
+	if got := out.Header.Get("X-Forwarded-For"); got != "10.0.0.1, 192.168.0.1" {
+		t.Errorf("X-Forwarded-For of h2 request = %q", got)
+	} else if got = out.Header.Get("X-Forwarded-Proto"); got != "https" {
+		t.Errorf("X-Forwarded-Proto of h2 request = %q", got)
+	}
+}
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/whoisnian/glp/global"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// Selection strategies of relay proxies in upstream pool.
+const (
+	PoolFailover   = "failover"   // the first healthy relay in order
+	PoolRoundRobin = "roundrobin" // healthy relays in turn
+	PoolLeastConn  = "leastconn"  // the healthy relay with fewest open connections
+
+	poolEjectAfter   = 3 // consecutive dial errors
+	poolCheckTimeout = 10 * time.Second
+)
+
+func validPoolStrategy(strategy string) bool {
+	return strategy == PoolFailover || strategy == PoolRoundRobin || strategy == PoolLeastConn
+}
+
+type RelayStatus struct {
+	Upstream     string
+	Addr         string
+	Healthy      bool
+	Active       int64
+	Failures     int
+	EjectedUntil time.Time
+	LastCheck    time.Time
+	LastError    string
+}
+
+// relay is a member of upstreamPool, and it counts open connections and consecutive dial errors through its relay proxy.
+// Connections of both dialer and transport are tracked, and for transport only the dial to relay proxy itself is counted.
+type relay struct {
+	upstream
+	addr   string
+	base   xproxy.Dialer
+	active atomic.Int64
+	pooled bool // only relays in pool with more than one relay will be ejected
+
+	failures   int
+	ejectUntil time.Time
+	lastCheck  time.Time
+	lastErr    string
+	mu         sync.Mutex
+}
+
+func newRelay(name string, rawURL string, tlsConfig *tls.Config, http2 bool) (*relay, error) {
+	base, transport, err := parseProxy(rawURL, tlsConfig.Clone(), http2)
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(rawURL) // already validated by parseProxy
+	r := &relay{addr: u.Host, base: base}
+	r.name, r.dialer, r.transport = name, r, transport
+	dialContext := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialContext(ctx, network, addr)
+		var stageErr *stageError
+		if err != nil && !errors.As(err, &stageErr) {
+			err = &stageError{stageProxy, err} // only relay proxy itself is dialed if transport sends CONNECT by itself
+		}
+		return r.track(conn, err)
+	}
+	return r, nil
+}
+
+func (r *relay) Dial(network, addr string) (net.Conn, error) {
+	return r.DialContext(context.Background(), network, addr)
+}
+
+func (r *relay) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return r.track(dialWithContext(ctx, r.base, network, addr))
+}
+
+func (r *relay) track(conn net.Conn, err error) (net.Conn, error) {
+	if errors.Is(err, context.Canceled) {
+		return nil, err // cancelled by client or shutdown, not a fault of relay
+	} else if err != nil {
+		if relayFault(err) {
+			r.fail(err)
+		}
+		return nil, err
+	}
+	r.succeed()
+	r.active.Add(1)
+	return &relayConn{Conn: conn, relay: r}, nil
+}
+
+// relayFault reports whether err is caused by relay proxy itself, rather than by target that relay proxy failed to reach.
+// Target is resolved by relay proxy, so dns errors are about address of relay proxy.
+func relayFault(err error) bool {
+	stage := upstreamErrorStage(err)
+	return stage == stageProxy || stage == stageDNS
+}
+
+func (r *relay) healthy(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !now.Before(r.ejectUntil)
+}
+
+// fail ejects relay after consecutive errors, and it will be tried again when ejection expires or health check succeeds.
+func (r *relay) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures++
+	r.lastErr = err.Error()
+	if now := time.Now(); r.pooled && r.failures >= poolEjectAfter && global.CFG.EjectPeriod > 0 && !now.Before(r.ejectUntil) {
+		r.ejectUntil = now.Add(global.CFG.EjectPeriod)
+		global.LOG.Warnf(context.Background(), "proxy: eject relay %s for %s after %d consecutive errors: %s", r.name, global.CFG.EjectPeriod, r.failures, r.lastErr)
+	}
+}
+
+func (r *relay) succeed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Now().Before(r.ejectUntil) {
+		global.LOG.Infof(context.Background(), "proxy: restore relay %s", r.name)
+	}
+	r.failures = 0
+	r.ejectUntil = time.Time{}
+}
+
+// check opens a tunnel to addr through relay proxy, like CONNECT for http relay.
+func (r *relay) check(ctx context.Context, addr string) {
+	checkCtx, cancel := context.WithTimeout(ctx, poolCheckTimeout)
+	defer cancel()
+	conn, err := dialWithContext(checkCtx, r.base, "tcp", addr)
+
+	r.mu.Lock()
+	r.lastCheck = time.Now()
+	r.mu.Unlock()
+	if err == nil {
+		conn.Close()
+		r.succeed()
+	} else if ctx.Err() == nil { // not stopped by shutdown
+		r.fail(errors.New("health check: " + err.Error()))
+	}
+}
+
+func (r *relay) status(upstream string) RelayStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	return RelayStatus{
+		Upstream:     upstream,
+		Addr:         r.addr,
+		Healthy:      !now.Before(r.ejectUntil),
+		Active:       r.active.Load(),
+		Failures:     r.failures,
+		EjectedUntil: r.ejectUntil,
+		LastCheck:    r.lastCheck,
+		LastError:    r.lastErr,
+	}
+}
+
+// relayConn decreases open connections of relay on the first Close.
+type relayConn struct {
+	net.Conn
+	relay *relay
+	once  sync.Once
+}
+
+func (c *relayConn) Close() error {
+	c.once.Do(func() { c.relay.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+// upstreamPool selects one of relay proxies for each connection by strategy, and skips ejected ones.
+type upstreamPool struct {
+	name     string
+	strategy string
+	relays   []*relay
+	next     atomic.Uint64
+}
+
+// newUpstreamPool creates pool from relay proxy urls separated by '|', and relays are named like 'name/host:port' if there are more than one.
+func newUpstreamPool(name string, rawURLs string, strategy string, tlsConfig *tls.Config, http2 bool) (*upstreamPool, error) {
+	p := &upstreamPool{name: name, strategy: strategy}
+	items := strings.Split(rawURLs, "|")
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		relayName := name
+		if len(items) > 1 {
+			relayName = name + "/" + item
+			if u, err := url.Parse(item); err == nil {
+				relayName = name + "/" + u.Host // hide credentials in logs
+			}
+		}
+		r, err := newRelay(relayName, item, tlsConfig, http2)
+		if err != nil {
+			return nil, err
+		}
+		p.relays = append(p.relays, r)
+	}
+	if len(p.relays) == 0 {
+		return nil, errors.New("proxy: empty upstream pool: " + name)
+	}
+	for _, r := range p.relays {
+		r.pooled = len(p.relays) > 1
+	}
+	return p, nil
+}
+
+// pick returns upstream of selected relay, and all relays are candidates if every one is ejected.
+func (p *upstreamPool) pick() *upstream {
+	if len(p.relays) == 1 {
+		return &p.relays[0].upstream
+	}
+	now := time.Now()
+	candidates := make([]*relay, 0, len(p.relays))
+	for _, r := range p.relays {
+		if r.healthy(now) {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.relays
+	}
+
+	switch p.strategy {
+	case PoolRoundRobin:
+		return &candidates[(p.next.Add(1)-1)%uint64(len(candidates))].upstream
+	case PoolLeastConn:
+		best := candidates[0]
+		for _, r := range candidates[1:] {
+			if r.active.Load() < best.active.Load() {
+				best = r
+			}
+		}
+		return &best.upstream
+	}
+	return &candidates[0].upstream
+}
+
+// healthCheck checks all relays every interval until ctx is done.
+func (p *upstreamPool) healthCheck(ctx context.Context, interval time.Duration, addr string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		wg := new(sync.WaitGroup)
+		for _, r := range p.relays {
+			wg.Add(1)
+			go func() {
+				r.check(ctx, addr)
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func (p *upstreamPool) status() []RelayStatus {
+	result := make([]RelayStatus, len(p.relays))
+	for i, r := range p.relays {
+		result[i] = r.status(p.name)
+	}
+	return result
+}
+
+// startHealthChecks runs health checks of pools with more than one relay in background until stopHealthChecks.
+// A single relay is always picked, so checking it only adds traffic.
+func (r *router) startHealthChecks(interval time.Duration, addr string) {
+	if interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stopChecks = cancel
+	for _, up := range r.upstreams {
+		if up.pool != nil && len(up.pool.relays) > 1 {
+			go up.pool.healthCheck(ctx, interval, addr)
+		}
+	}
+}
+
+func (r *router) stopHealthChecks() {
+	if r.stopChecks != nil {
+		r.stopChecks()
+	}
+}
+
+// relayStatus returns state of relays in all pools sorted by upstream name.
+func (r *router) relayStatus() (result []RelayStatus) {
+	for _, up := range r.upstreams {
+		if up.pool != nil {
+			result = append(result, up.pool.status()...)
+		}
+	}
+	slices.SortStableFunc(result, func(a, b RelayStatus) int { return strings.Compare(a.Upstream, b.Upstream) })
+	return result
+}
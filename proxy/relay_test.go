@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/whoisnian/glp/global"
+)
+
+func TestRelayEjection(t *testing.T) {
+	if global.CFG.EjectPeriod == 0 {
+		global.CFG.EjectPeriod = time.Minute
+		defer func() { global.CFG.EjectPeriod = 0 }()
+	}
+
+	tests := []struct {
+		name    string
+		status  int
+		ejected bool
+	}{
+		{"target unreachable", http.StatusBadGateway, false},
+		{"target timeout", http.StatusGatewayTimeout, false},
+		{"relay forbidden", http.StatusForbidden, true},
+	}
+	for _, tt := range tests {
+		addr, _ := startFakeProxy(t, func(req *http.Request) fakeReply { return fakeReply{status: tt.status} })
+		pool, err := newUpstreamPool("up", "http://"+addr+"|http://"+addr, PoolFailover, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := pool.relays[0]
+		for range poolEjectAfter + 1 {
+			if _, err = dialFakeProxy(t, r); err == nil {
+				t.Fatalf("%s: DialContext succeeded, want error", tt.name)
+			}
+		}
+		if ejected := !r.healthy(time.Now()); ejected != tt.ejected {
+			t.Errorf("%s: relay ejected = %t, want %t (%s)", tt.name, ejected, tt.ejected, r.status("up").LastError)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/whoisnian/glp/global"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// Reserved upstream names for routing rules.
+const (
+	routeDirect  = "direct"
+	routeReject  = "reject"
+	routeDefault = "default" // relay proxy from command line, or direct if not set
+)
+
+var errRouteRejected = errors.New("proxy: rejected by routing rule")
+
+// upstream is a named way to reach destinations, and both dialer and transport are nil for reject.
+// For relay proxies, pool is set instead and router resolves it to the upstream of selected relay.
+type upstream struct {
+	name      string
+	dialer    xproxy.Dialer
+	transport *http.Transport
+	pool      *upstreamPool
+}
+
+func (u *upstream) rejected() bool {
+	return u.dialer == nil
+}
+
+type routeKey struct{}
+
+func withRoute(ctx context.Context, route *upstream) context.Context {
+	return context.WithValue(ctx, routeKey{}, route)
+}
+
+// routeFrom returns the upstream selected for request in serveH2, or nil if not available.
+func routeFrom(ctx context.Context) *upstream {
+	route, _ := ctx.Value(routeKey{}).(*upstream)
+	return route
+}
+
+// routeRule maps destinations to upstream, and pattern is one of:
+// '.example.com' for domain suffix, 'example.com' or '*.example.com' for host glob, '10.0.0.0/8' for CIDR, ':443' for port.
+type routeRule struct {
+	pattern  string
+	port     string
+	prefix   netip.Prefix
+	upstream *upstream
+}
+
+func (r *routeRule) match(host string, port string) bool {
+	if r.port != "" {
+		return r.port == port
+	} else if r.prefix.IsValid() {
+		addr, err := netip.ParseAddr(host)
+		return err == nil && r.prefix.Contains(addr.Unmap())
+	} else if strings.HasPrefix(r.pattern, ".") {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		return host == r.pattern[1:] || strings.HasSuffix(host, r.pattern)
+	}
+	return matchHost(r.pattern, host)
+}
+
+// router chooses upstream for each destination by rules in order, and falls back to default upstream.
+type router struct {
+	rules      []routeRule
+	upstreams  map[string]*upstream
+	pac        *pacResolver // chooses default upstream per destination if relay is a PAC source
+	stopChecks context.CancelFunc
+}
+
+// newRouter creates router from command line values:
+// relay is the default upstream url or PAC source, upstreams is a list of 'name=url' items, and rules is a list of 'pattern=name' items.
+func newRouter(relay string, upstreams string, rules string, tlsConfig *tls.Config, http2 bool) (r *router, err error) {
+	r = &router{upstreams: map[string]*upstream{routeReject: {name: routeReject}}}
+	add := func(name string, rawURL string) error {
+		if _, ok := r.upstreams[name]; ok {
+			return errors.New("proxy: duplicate upstream name: " + name)
+		}
+		u := &upstream{name: name}
+		if rawURL == "" {
+			u.dialer, u.transport, err = parseProxy(rawURL, tlsConfig.Clone(), http2)
+		} else {
+			u.pool, err = newUpstreamPool(name, rawURL, global.CFG.PoolPolicy, tlsConfig, http2)
+		}
+		if err != nil {
+			return err
+		}
+		r.upstreams[name] = u
+		return nil
+	}
+	if err = add(routeDirect, ""); err != nil {
+		return nil, err
+	}
+	if isPACSource(relay) {
+		if r.pac, err = newPACResolver(relay, r.upstreams[routeDirect], tlsConfig, http2); err != nil {
+			return nil, fmt.Errorf("proxy.newPACResolver: %w", err)
+		}
+		r.upstreams[routeDefault] = &upstream{name: routeDefault} // placeholder for rules, resolved by pac in route
+	} else if err = add(routeDefault, relay); err != nil {
+		return nil, err
+	}
+	for _, item := range splitList(upstreams) {
+		name, rawURL, ok := strings.Cut(item, "=")
+		if !ok || name == "" {
+			return nil, errors.New("proxy: invalid upstream: " + item)
+		} else if err = add(name, rawURL); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, item := range splitList(rules) {
+		pattern, name, ok := strings.Cut(item, "=")
+		if !ok || pattern == "" {
+			return nil, errors.New("proxy: invalid routing rule: " + item)
+		}
+		rule := routeRule{pattern: strings.ToLower(pattern), upstream: r.upstreams[name]}
+		if rule.upstream == nil {
+			return nil, errors.New("proxy: unknown upstream in routing rule: " + item)
+		}
+		if port, ok := strings.CutPrefix(pattern, ":"); ok {
+			rule.port = port
+		} else if strings.Contains(pattern, "/") {
+			if rule.prefix, err = netip.ParsePrefix(pattern); err != nil {
+				return nil, errors.New("proxy: invalid CIDR in routing rule: " + item)
+			}
+			rule.prefix = rule.prefix.Masked()
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// route returns upstream for destination u, and the port is inferred from scheme if missing.
+func (r *router) route(u *url.URL) *upstream {
+	host, port := u.Hostname(), u.Port()
+	if port == "" && u.Scheme == "https" {
+		port = "443"
+	} else if port == "" {
+		port = "80"
+	}
+	result := r.upstreams[routeDefault]
+	for i := range r.rules {
+		if r.rules[i].match(host, port) {
+			result = r.rules[i].upstream
+			break
+		}
+	}
+	if result.name == routeDefault && r.pac != nil {
+		return r.pac.route(u, port)
+	} else if result.pool != nil {
+		return result.pool.pick()
+	}
+	return result
+}
@@ -8,9 +8,11 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"os"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,7 +20,7 @@ import (
 	"github.com/whoisnian/glb/logger"
 	"github.com/whoisnian/glb/util/fsutil"
 	"github.com/whoisnian/glp/global"
-	xproxy "golang.org/x/net/proxy"
+	"golang.org/x/net/http2"
 )
 
 var ErrServerClosed = errors.New("proxy: server closed")
@@ -29,8 +31,23 @@ type Server struct {
 	klogw io.WriteCloser
 
 	listener  net.Listener
-	dialer    xproxy.Dialer
-	transport *http.Transport
+	router    *router
+	tlsPolicy *tlsPolicy
+
+	passthrough   *hostMatcher
+	learned       learnedHosts
+	upstreamCerts upstreamCertCache
+	auth          *proxyAuth // nil means no authentication
+
+	socksListener net.Listener
+	socksUser     []byte // empty means no authentication
+	socksPass     []byte
+
+	transparentListener net.Listener
+
+	h2Base   *http.Server
+	h2Server *http2.Server
+	h2Proxy  *httputil.ReverseProxy
 
 	shutdown    atomic.Bool
 	listenerWg  sync.WaitGroup
@@ -40,6 +57,27 @@ type Server struct {
 
 func NewServer(addr string, proxy string, klogf string) (s *Server, err error) {
 	s = &Server{addr: addr, proxy: proxy}
+	if !validProxyProtoMode(global.CFG.ProxyProto) {
+		return nil, errors.New("proxy: invalid PROXY protocol mode: " + global.CFG.ProxyProto)
+	}
+	if !validPoolStrategy(global.CFG.PoolPolicy) {
+		return nil, errors.New("proxy: invalid pool strategy: " + global.CFG.PoolPolicy)
+	}
+	if global.CFG.HealthCheck > 0 && global.CFG.HealthAddr == "" {
+		return nil, errors.New("proxy: missing healthaddr for health checks")
+	}
+	if global.CFG.AuthFile != "" {
+		if s.auth, err = newProxyAuth(global.CFG.AuthFile); err != nil {
+			return nil, fmt.Errorf("proxy.newProxyAuth: %w", err)
+		}
+	}
+	if global.CFG.SocksAuth != "" {
+		user, pass, ok := strings.Cut(global.CFG.SocksAuth, ":")
+		if !ok || user == "" || len(user) > 255 || len(pass) > 255 {
+			return nil, errors.New("proxy: invalid socks5 auth, expected user:pass")
+		}
+		s.socksUser, s.socksPass = []byte(user), []byte(pass)
+	}
 	if klogf != "" {
 		fpath, err := fsutil.ExpandHomeDir(klogf)
 		if err != nil {
@@ -49,34 +87,67 @@ func NewServer(addr string, proxy string, klogf string) (s *Server, err error) {
 			return nil, fmt.Errorf("os.Create: %w", err)
 		}
 	}
-	s.dialer, s.transport, err = parseProxy(proxy)
-	return s, err
+	if s.tlsPolicy, err = newTLSPolicy(global.CFG.UpstreamRoots, global.CFG.InsecureHosts, global.CFG.UpstreamPins, global.CFG.ClientCerts); err != nil {
+		return nil, fmt.Errorf("proxy.newTLSPolicy: %w", err)
+	}
+	if s.passthrough, err = newHostMatcher(global.CFG.Passthrough); err != nil {
+		return nil, fmt.Errorf("proxy.newHostMatcher: %w", err)
+	}
+	if s.router, err = newRouter(proxy, global.CFG.Upstreams, global.CFG.Routes, s.tlsPolicy.tlsConfig(""), !global.CFG.HTTP1Only); err != nil {
+		return nil, fmt.Errorf("proxy.newRouter: %w", err)
+	}
+	s.router.startHealthChecks(global.CFG.HealthCheck, global.CFG.HealthAddr)
+	if err = s.setupH2(); err != nil {
+		return nil, fmt.Errorf("proxy.setupH2: %w", err)
+	}
+	return s, nil
 }
 
 func (s *Server) ListenAndServe() (err error) {
+	return s.listenAndServe(&s.listener, net.ListenConfig{}, s.addr, s.serve)
+}
+
+// ListenAndServeSocks5 accepts socks5 clients on addr, and their connections share the same interception as CONNECT requests.
+func (s *Server) ListenAndServeSocks5(addr string) (err error) {
+	return s.listenAndServe(&s.socksListener, net.ListenConfig{}, addr, s.serveSocks5)
+}
+
+func (s *Server) listenAndServe(listener *net.Listener, lc net.ListenConfig, addr string, serve func(net.Conn)) (err error) {
 	if s.shutdown.Load() {
 		return ErrServerClosed
 	}
-	if s.listener != nil {
+
+	s.mu.Lock()
+	if *listener != nil {
+		s.mu.Unlock()
 		return errors.New("proxy: server already listening")
 	}
-
-	s.listenerWg.Add(1)
-	defer s.listenerWg.Done()
-	s.listener, err = net.Listen("tcp", s.addr)
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
 	if err != nil {
+		s.mu.Unlock()
 		return err
 	}
+	*listener = ln
+	s.listenerWg.Add(1)
+	s.mu.Unlock()
+	defer s.listenerWg.Done()
 
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			if s.shutdown.Load() {
 				return ErrServerClosed
 			}
 			return err
 		}
-		go s.serve(conn)
+		go func() {
+			if pc, err := acceptProxyProto(conn, global.CFG.ProxyProto); err != nil {
+				global.LOG.Errorf(context.Background(), "proxy: acceptProxyProto %v %s", conn.RemoteAddr(), err.Error())
+				conn.Close()
+			} else {
+				serve(pc)
+			}
+		}()
 	}
 }
 
@@ -92,34 +163,109 @@ func (s *Server) serve(conn net.Conn) {
 	}()
 	s.trackConn(bufioConn, cancel, true)
 
-	req, err := http.ReadRequest(bufioConn.Reader())
-	if err != nil {
-		global.LOG.Error(ctx, "http.ReadRequest", logger.Error(err))
-		return
-	}
-	req = req.WithContext(ctx)
-
-	if req.URL.Host == "" {
-		s.handleRequest(bufioConn, req)
-	} else if req.Method == http.MethodConnect {
-		bufioConn.Write([]byte("HTTP/1.1 200 Connection established\r\nContent-Length: 0\r\n\r\n"))
-
-		if data, err := bufioConn.Reader().Peek(8); err != nil {
-			global.LOG.Warnf(ctx, "proxy: fallback to tcp error %v", err)
-			s.handleTCP(bufioConn, req, false)
-		} else if sniffTLSHandshakePrefix(data) {
-			s.handleTLS(bufioConn, req)
-		} else if sniffHTTPMethodPrefix(data) {
-			s.handleHTTP(bufioConn, req)
-		} else {
-			global.LOG.Warnf(ctx, "proxy: fallback to tcp unknown %s", strconv.QuoteToGraphic(string(data)))
-			s.handleTCP(bufioConn, req, false)
+	for first := true; ; first = false {
+		req, err := readRequest(ctx, bufioConn)
+		if err != nil {
+			if first || !isIdleClose(err) {
+				global.LOG.Error(ctx, "http.ReadRequest", logger.Error(err))
+			}
+			return
 		}
+		if s.auth != nil && !isPACRequest(req) {
+			user, stale, ok := s.auth.authenticate(req)
+			if !ok {
+				global.LOG.Warnf(ctx, "proxy: authentication required %s %s from %s", req.Method, req.URL, req.RemoteAddr)
+				writeResponse(bufioConn, http.StatusProxyAuthRequired, s.auth.challenge(stale), nil)
+				req.Body.Close() // consume the remaining body before next request
+				if req.Close {
+					return
+				}
+				continue
+			}
+			req.Header.Del("Proxy-Authorization") // hop-by-hop header, never forward it to upstream
+			req = req.WithContext(withUser(req.Context(), user))
+		}
+
+		if req.Method == http.MethodConnect && req.URL.Host != "" {
+			bufioConn.Write([]byte("HTTP/1.1 200 Connection established\r\nContent-Length: 0\r\n\r\n"))
+			s.serveConnect(bufioConn, req)
+			return
+		}
+		if !s.dispatch(bufioConn, req) || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// serveConnect sniffs the first bytes of established tunnel, and intercepts tls or http protocol in it.
+func (s *Server) serveConnect(conn *BufioConn, req *http.Request) {
+	if data, err := conn.Reader().Peek(8); err != nil {
+		global.LOG.Warnf(req.Context(), "proxy: fallback to tcp error %v", err)
+		s.handleTCP(conn, req, false)
+	} else if sniffTLSHandshakePrefix(data) {
+		s.handleTLS(conn, req)
+	} else if sniffHTTPMethodPrefix(data) {
+		s.serveTunnel(conn, req, "http")
 	} else {
-		s.handleHTTP(bufioConn, req)
+		global.LOG.Warnf(req.Context(), "proxy: fallback to tcp unknown %s", strconv.QuoteToGraphic(string(data)))
+		s.handleTCP(conn, req, false)
 	}
 }
 
+// serveTunnel handles http requests inside a CONNECT tunnel until the connection should be closed.
+// The scheme is 'https' for intercepted tls connections, and 'http' for plain connections.
+func (s *Server) serveTunnel(conn *BufioConn, connectReq *http.Request, scheme string) {
+	ctx := connectReq.Context()
+	for first := true; ; first = false {
+		req, err := readRequest(ctx, conn)
+		if err != nil {
+			if first || !isIdleClose(err) {
+				global.LOG.Errorf(ctx, "proxy: serveTunnel.ReadRequest %s %s %s", connectReq.Method, connectReq.URL, err.Error())
+			}
+			return
+		}
+		req.URL.Scheme = scheme
+		if req.URL.Host = req.Host; req.URL.Host == "" {
+			req.URL.Host = connectReq.URL.Host
+		}
+		if !s.dispatch(conn, req) || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// dispatch handles a single request on keep-alive connection, and reports whether the connection can be reused.
+func (s *Server) dispatch(conn *BufioConn, req *http.Request) (keepAlive bool) {
+	if req.URL.Host == "" || isCAHost(req.URL.Host) {
+		s.handleRequest(conn, req)
+		req.Body.Close() // consume the remaining body before next request
+		return !req.Close
+	}
+	return s.handleHTTP(conn, req)
+}
+
+// readRequest waits for the next request on conn until idle timeout,
+// and gives up early if ctx is cancelled by Shutdown.
+func readRequest(ctx context.Context, conn *BufioConn) (*http.Request, error) {
+	if global.CFG.IdleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(global.CFG.IdleTimeout))
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Unix(1, 0)) })
+	req, err := http.ReadRequest(conn.Reader())
+	stop()
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	req.RemoteAddr = conn.RemoteAddr().String()
+	return req.WithContext(ctx), nil
+}
+
+// isIdleClose reports whether err is caused by closing an idle keep-alive connection.
+func isIdleClose(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed)
+}
+
 func (s *Server) trackConn(conn *BufioConn, cancel context.CancelFunc, add bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -135,8 +281,18 @@ func (s *Server) trackConn(conn *BufioConn, cancel context.CancelFunc, add bool)
 
 func (s *Server) Shutdown(ctx context.Context) (err error) {
 	s.shutdown.Store(true)
-	err = s.listener.Close()
+	s.mu.Lock()
+	for _, ln := range []net.Listener{s.listener, s.socksListener, s.transparentListener} {
+		if ln == nil {
+			continue
+		} else if err2 := ln.Close(); err == nil {
+			err = err2
+		}
+	}
+	s.mu.Unlock()
 	s.listenerWg.Wait()
+	s.router.stopHealthChecks()
+	s.h2Base.Shutdown(ctx) // send GOAWAY to h2 connections
 
 	if s.klogw != nil && err == nil {
 		err = s.klogw.Close()
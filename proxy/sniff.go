@@ -78,74 +78,24 @@ const (
 	extensionServerName    uint16 = 0
 )
 
-func sniffTLSHandshakeServerName(conn *CachedConn) (string, error) {
+func sniffClientHello(conn *CachedConn) (*ClientHello, error) {
 	hdr, err := conn.Prefetch(recordHeaderLen)
 	if err != nil {
-		return "", err
+		return nil, err
 	} else if len(hdr) != recordHeaderLen || hdr[0] != recordTypeHandshake {
-		return "", errors.New("proxy: invalid TLS record type")
+		return nil, errors.New("proxy: invalid TLS record type")
 	}
 
 	recordLength := int(hdr[3])<<8 | int(hdr[4])
 	if recordLength <= 0 || recordLength > 16384 {
-		return "", errors.New("proxy: invalid TLS record length")
+		return nil, errors.New("proxy: invalid TLS record length")
 	}
 
 	data, err := conn.Prefetch(recordLength)
 	if err != nil {
-		return "", err
+		return nil, err
 	} else if len(data) != recordLength {
-		return "", errors.New("proxy: unexpected TLS record read length")
+		return nil, errors.New("proxy: unexpected TLS record read length")
 	}
-	return parseHandshakeRecord(data)
-}
-
-func parseHandshakeRecord(data []byte) (string, error) {
-	if data[0] != messageTypeClientHello {
-		return "", errors.New("proxy: invalid TLS client hello message type")
-	}
-	// skip HandshakeType(1) + HandshakeLength(3) + ProtocolVersion(2) + Random(32)
-	data = data[38:]
-
-	// skip SessionID(1+n)
-	sessionIdLength := int(data[0])
-	data = data[1+sessionIdLength:]
-
-	// skip CipherSuites(2+n)
-	cipherSuitesLength := int(data[0])<<8 | int(data[1])
-	data = data[2+cipherSuitesLength:]
-
-	// skip CompressionMethods(1+n)
-	compressionMethodsLength := int(data[0])
-	data = data[1+compressionMethodsLength:]
-	if len(data) == 0 {
-		return "", nil
-	}
-
-	extensionsLength := int(data[0])<<8 | int(data[1])
-	data = data[2:]
-	if len(data) != extensionsLength {
-		return "", errors.New("proxy: invalid client hello extensions length")
-	}
-	for len(data) > 0 {
-		extType := uint16(data[0])<<8 | uint16(data[1])
-		extLength := int(data[2])<<8 | int(data[3])
-		extData := data[4 : 4+extLength]
-
-		// https://datatracker.ietf.org/doc/html/rfc6066#section-3
-		if extType == extensionServerName {
-			extData = extData[2:]
-			for len(extData) > 0 {
-				nameType := extData[0]
-				nameLength := int(extData[1])<<8 | int(extData[2])
-				if nameType == 0 && nameLength > 0 {
-					return string(extData[3 : 3+nameLength]), nil
-				}
-				extData = extData[3+nameLength:]
-			}
-		}
-		data = data[4+extLength:]
-	}
-
-	return "", nil
+	return parseClientHello(data)
 }
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"runtime/debug"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/whoisnian/glp/global"
+)
+
+// https://www.rfc-editor.org/rfc/rfc1928
+// https://www.rfc-editor.org/rfc/rfc1929
+const (
+	socks5Version       = 0x05
+	socks5AuthVersion   = 0x01
+	socks5AuthNone      = 0x00
+	socks5AuthPassword  = 0x02
+	socks5AuthNoAccept  = 0xff
+	socks5CmdConnect    = 0x01
+	socks5AddrIPv4      = 0x01
+	socks5AddrDomain    = 0x03
+	socks5AddrIPv6      = 0x04
+	socks5ReplySuccess  = 0x00
+	socks5ReplyFailure  = 0x01
+	socks5ReplyRuleset  = 0x02
+	socks5ReplyNetwork  = 0x03
+	socks5ReplyHost     = 0x04
+	socks5ReplyRefused  = 0x05
+	socks5ReplyCmd      = 0x07
+	socks5ReplyAddrType = 0x08
+
+	socks5HandshakeTimeout = 10 * time.Second
+)
+
+var errSocks5Auth = errors.New("proxy: socks5 authentication failed")
+
+// serveSocks5 completes socks5 handshake with client, and then handles the tunnel like CONNECT request.
+func (s *Server) serveSocks5(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bufioConn := NewBufioConn(conn)
+	defer func() {
+		if err := recover(); err != nil {
+			global.LOG.Errorf(ctx, "proxy: panic serving socks5 %v: %v\n%s", conn.RemoteAddr(), err, debug.Stack())
+		}
+		bufioConn.Close()
+		s.trackConn(bufioConn, cancel, false)
+	}()
+	s.trackConn(bufioConn, cancel, true)
+
+	bufioConn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	addr, err := s.socks5Handshake(bufioConn)
+	if err != nil {
+		global.LOG.Errorf(ctx, "proxy: socks5Handshake %v %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+	req := newConnectRequest(ctx, addr, conn.RemoteAddr())
+	route := s.router.route(req.URL)
+	if route.rejected() {
+		writeSocks5Reply(bufioConn, socks5ReplyRuleset)
+		global.LOG.Errorf(ctx, "proxy: serveSocks5 %s %s %s", req.Method, req.URL, errRouteRejected.Error())
+		return
+	}
+	if !s.isPassthrough(req) {
+		// reply before dialing upstream, the same as '200 Connection established' for CONNECT request,
+		// and errors of upstream are passed to client by interception like error pages
+		err = writeSocks5Reply(bufioConn, socks5ReplySuccess)
+		bufioConn.SetDeadline(time.Time{})
+		if err == nil {
+			s.serveConnect(bufioConn, req)
+		}
+		return
+	}
+
+	// connection to passthrough host is never intercepted, so dial upstream first and report its error by reply code
+	start := time.Now()
+	upstream, err := dialUpstream(ctx, route.dialer, route.name, addr)
+	if err != nil {
+		writeSocks5Reply(bufioConn, socks5ReplyFor(err))
+		global.LOG.Errorf(ctx, "proxy: serveSocks5 %s %s %s", req.Method, req.URL, err.Error())
+		return
+	}
+	err = writeSocks5Reply(bufioConn, socks5ReplySuccess)
+	bufioConn.SetDeadline(time.Time{})
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	s.pipeTCP(bufioConn, upstream, req, route, start)
+}
+
+// socks5ReplyFor returns reply code for error of dialing upstream.
+func socks5ReplyFor(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ReplyRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5ReplyNetwork
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), upstreamErrorStatus(err) == http.StatusGatewayTimeout:
+		return socks5ReplyHost
+	case upstreamErrorStage(err) == stageConnect:
+		return socks5ReplyHost // reported by relay proxy
+	}
+	return socks5ReplyFailure
+}
+
+// socks5Handshake negotiates authentication method and reads CONNECT command from client, and returns the target address.
+// The reply of CONNECT command is left to caller.
+func (s *Server) socks5Handshake(conn *BufioConn) (addr string, err error) {
+	var buf [255]byte
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	} else if buf[0] != socks5Version {
+		return "", errors.New("proxy: unsupported socks version " + strconv.Itoa(int(buf[0])))
+	}
+	methods := buf[:buf[1]]
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	want := byte(socks5AuthNone)
+	if len(s.socksUser) > 0 {
+		want = socks5AuthPassword
+	}
+	if !bytes.Contains(methods, []byte{want}) {
+		conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return "", errors.New("proxy: no acceptable socks5 authentication method")
+	}
+	if _, err = conn.Write([]byte{socks5Version, want}); err != nil {
+		return "", err
+	}
+	if want == socks5AuthPassword {
+		if err = s.socks5Auth(conn); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err = io.ReadFull(conn, buf[:4]); err != nil {
+		return "", err
+	} else if buf[0] != socks5Version {
+		return "", errors.New("proxy: unsupported socks version " + strconv.Itoa(int(buf[0])))
+	} else if buf[1] != socks5CmdConnect {
+		writeSocks5Reply(conn, socks5ReplyCmd)
+		return "", errors.New("proxy: unsupported socks5 command " + strconv.Itoa(int(buf[1])))
+	}
+
+	var host string
+	switch buf[3] {
+	case socks5AddrIPv4:
+		if _, err = io.ReadFull(conn, buf[:4]); err != nil {
+			return "", err
+		}
+		host = netip.AddrFrom4([4]byte(buf[:4])).String()
+	case socks5AddrIPv6:
+		if _, err = io.ReadFull(conn, buf[:16]); err != nil {
+			return "", err
+		}
+		host = netip.AddrFrom16([16]byte(buf[:16])).String()
+	case socks5AddrDomain:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return "", err
+		}
+		domain := buf[:buf[0]]
+		if _, err = io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		writeSocks5Reply(conn, socks5ReplyAddrType)
+		return "", errors.New("proxy: unsupported socks5 address type " + strconv.Itoa(int(buf[3])))
+	}
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	if host == "" || port == 0 {
+		writeSocks5Reply(conn, socks5ReplyFailure)
+		return "", errors.New("proxy: invalid socks5 target address")
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func (s *Server) socks5Auth(conn *BufioConn) error {
+	var buf [255]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	} else if buf[0] != socks5AuthVersion {
+		return errors.New("proxy: unsupported socks5 auth version " + strconv.Itoa(int(buf[0])))
+	}
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return err
+	}
+	pass := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return err
+	}
+
+	userOk := subtle.ConstantTimeCompare(user, s.socksUser)
+	passOk := subtle.ConstantTimeCompare(pass, s.socksPass)
+	if userOk&passOk != 1 {
+		conn.Write([]byte{socks5AuthVersion, 0x01})
+		return errSocks5Auth
+	}
+	_, err := conn.Write([]byte{socks5AuthVersion, 0x00})
+	return err
+}
+
+// writeSocks5Reply writes reply with zero bind address, since clients seldom use it for CONNECT command.
+func writeSocks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socks5Version, rep, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func newTestSocksServer(t *testing.T, passthrough string, rules string) *Server {
+	t.Helper()
+	s := &Server{tlsPolicy: &tlsPolicy{}}
+	var err error
+	if s.router, err = newRouter("", "", rules, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if s.passthrough, err = newHostMatcher(passthrough); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// socks5Connect returns CONNECT command of socks5 for domain target.
+func socks5Connect(host string, port uint16) []byte {
+	req := append([]byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrDomain, byte(len(host))}, host...)
+	return binary.BigEndian.AppendUint16(req, port)
+}
+
+// exchangeSocks5 serves a socks5 connection with s, sends request to it, and returns replies until it closes the connection.
+func exchangeSocks5(s *Server, request []byte) []byte {
+	client, server := net.Pipe()
+	go s.serveSocks5(server)
+	go client.Write(request)
+	reply, _ := io.ReadAll(client)
+	client.Close()
+	return reply
+}
+
+// https://www.rfc-editor.org/rfc/rfc1928#section-4
+func TestSocks5Handshake(t *testing.T) {
+	const (
+		noAuth    = "050100"
+		password  = "050102"
+		userPass  = "0104757365720470617373"   // user:pass
+		wrongPass = "01047573657204776f726e67" // user:worn
+		connect   = "050100017f00000101bb"     // 127.0.0.1:443
+	)
+	tests := []struct {
+		name  string
+		user  string
+		input string
+		addr  string
+		reply string
+		fail  bool
+	}{
+		{"ipv4", "", noAuth + connect, "127.0.0.1:443", "0500", false},
+		{"ipv6", "", noAuth + "0501000420010db800000000000000000000000101bb", "[2001:db8::1]:443", "0500", false},
+		{"domain", "", noAuth + "050100030b6578616d706c652e636f6d01bb", "example.com:443", "0500", false},
+		{"password", "user", password + userPass + connect, "127.0.0.1:443", "0502" + "0100", false},
+		{"wrong password", "user", password + wrongPass, "", "0502" + "0101", true},
+		{"password required", "user", noAuth, "", "05ff", true},
+		{"socks4", "", "040100", "", "", true},
+		{"bind command", "", noAuth + "050200017f00000101bb", "", "0500" + "05070001000000000000", true},
+		{"unknown address type", "", noAuth + "05010005", "", "0500" + "05080001000000000000", true},
+		{"zero port", "", noAuth + "050100017f0000010000", "", "0500" + "05010001000000000000", true},
+	}
+	for _, tt := range tests {
+		s := &Server{}
+		if tt.user != "" {
+			s.socksUser, s.socksPass = []byte(tt.user), []byte("pass")
+		}
+		client, server := net.Pipe()
+		go client.Write(mustDecodeHex(tt.input))
+		reply := make(chan []byte)
+		go func() {
+			data, _ := io.ReadAll(client)
+			reply <- data
+		}()
+
+		addr, err := s.socks5Handshake(NewBufioConn(server))
+		server.Close()
+		if got := <-reply; !bytes.Equal(got, mustDecodeHex(tt.reply)) {
+			t.Errorf("%s: reply = %x, want %s", tt.name, got, tt.reply)
+		}
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: socks5Handshake() = %s, want error", tt.name, addr)
+			}
+		} else if err != nil || addr != tt.addr {
+			t.Errorf("%s: socks5Handshake() = %s, %v, want %s", tt.name, addr, err, tt.addr)
+		}
+		client.Close()
+	}
+}
+
+func TestSocks5ReplyCode(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := uint16(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close() // nothing is listening at closed port
+
+	s := newTestSocksServer(t, "localhost", "blocked.test=reject")
+	tests := []struct {
+		name    string
+		request []byte
+		reply   byte
+	}{
+		{"refused passthrough", socks5Connect("localhost", closedPort), socks5ReplyRefused},
+		{"rejected by rule", socks5Connect("blocked.test", 443), socks5ReplyRuleset},
+	}
+	for _, tt := range tests {
+		request := append([]byte{socks5Version, 1, socks5AuthNone}, tt.request...)
+		want := []byte{socks5Version, socks5AuthNone, socks5Version, tt.reply, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+		if reply := exchangeSocks5(s, request); !bytes.Equal(reply, want) {
+			t.Errorf("%s: reply = %x, want %x", tt.name, reply, want)
+		}
+	}
+}
+
+func TestSocks5ReplyFor(t *testing.T) {
+	dial := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: errno}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"refused", dial(syscall.ECONNREFUSED), socks5ReplyRefused},
+		{"network unreachable", dial(syscall.ENETUNREACH), socks5ReplyNetwork},
+		{"host unreachable", dial(syscall.EHOSTUNREACH), socks5ReplyHost},
+		{"dns", &net.DNSError{Err: "no such host", Name: "missing.test", IsNotFound: true}, socks5ReplyHost},
+		{"timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, socks5ReplyHost},
+		{"relay bad gateway", &stageError{stageConnect, errors.New("proxy: unexpected CONNECT status: 502 Bad Gateway")}, socks5ReplyHost},
+		{"relay forbidden", &stageError{stageProxy, errors.New("proxy: unexpected CONNECT status: 403 Forbidden")}, socks5ReplyFailure},
+	}
+	for _, tt := range tests {
+		if got := socks5ReplyFor(tt.err); got != tt.want {
+			t.Errorf("%s: socks5ReplyFor(%v) = %#x, want %#x", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/whoisnian/glp/global"
+)
+
+// ListenAndServeTransparent accepts connections redirected by iptables, and intercepts them like CONNECT requests.
+// The original destination is recovered by SO_ORIGINAL_DST for REDIRECT, or from local address for TPROXY,
+// so it is only supported on linux.
+func (s *Server) ListenAndServeTransparent(addr string) (err error) {
+	return s.listenAndServe(&s.transparentListener, transparentListenConfig(), addr, s.serveTransparent)
+}
+
+func (s *Server) serveTransparent(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bufioConn := NewBufioConn(conn)
+	defer func() {
+		if err := recover(); err != nil {
+			global.LOG.Errorf(ctx, "proxy: panic serving transparent %v: %v\n%s", conn.RemoteAddr(), err, debug.Stack())
+		}
+		bufioConn.Close()
+		s.trackConn(bufioConn, cancel, false)
+	}()
+	s.trackConn(bufioConn, cancel, true)
+
+	dst, err := originalDst(unwrapConn(conn))
+	if err != nil {
+		// TPROXY keeps the original destination as local address, which is different from the listening port
+		local, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+		if local.Port() == listenPort(s.transparentListener) {
+			global.LOG.Errorf(ctx, "proxy: originalDst %v %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+		dst = local
+	}
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+
+	// use sni as hostname for tls, and the Host header will be used for http in serveTunnel
+	addr := dst.String()
+	if sni := peekServerName(bufioConn.Reader()); sni != "" {
+		addr = net.JoinHostPort(sni, strconv.Itoa(int(dst.Port())))
+	}
+	s.serveConnect(bufioConn, newConnectRequest(ctx, addr, conn.RemoteAddr()))
+}
+
+// peekServerName returns sni in the first tls record without consuming it from br.
+// Empty string is returned if data is not a ClientHello, or the record does not fit in br.
+func peekServerName(br *bufio.Reader) string {
+	hdr, err := br.Peek(recordHeaderLen)
+	if err != nil || !sniffTLSHandshakePrefix(hdr) {
+		return ""
+	}
+	data, err := br.Peek(recordHeaderLen + (int(hdr[3])<<8 | int(hdr[4])))
+	if err != nil {
+		return ""
+	}
+	hello, err := parseClientHello(data[recordHeaderLen:])
+	if err != nil {
+		return ""
+	}
+	return hello.ServerName
+}
+
+func listenPort(ln net.Listener) uint16 {
+	if ln == nil {
+		return 0
+	}
+	addr, _ := netip.ParseAddrPort(ln.Addr().String())
+	return addr.Port()
+}
+
+// newConnectRequest creates the equivalent of CONNECT request for connections without http handshake.
+func newConnectRequest(ctx context.Context, addr string, remoteAddr net.Addr) *http.Request {
+	return (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       addr,
+		RemoteAddr: remoteAddr.String(),
+	}).WithContext(ctx)
+}
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whoisnian/glb/util/fsutil"
+	"github.com/whoisnian/glp/global"
+)
+
+var (
+	errMissingCertificate = errors.New("proxy: missing upstream certificate")
+	errPinMismatch        = errors.New("proxy: upstream certificate does not match any pin")
+)
+
+// tlsPolicy decides how to verify upstream server certificates and which client certificate to present for each host,
+// so the same policy can be applied to both handleTCP and http.Transport.
+type tlsPolicy struct {
+	roots         *x509.CertPool // nil means system roots
+	insecureHosts []string       // host patterns allowed to present invalid certificates
+	pins          []hostPin
+	clientCerts   []hostClientCert
+
+	transports sync.Map // transportKey => *http.Transport, only for special policy
+}
+
+// hostPin is the base64 encoded sha256 digest of SubjectPublicKeyInfo for hosts matching pattern.
+// https://datatracker.ietf.org/doc/html/rfc7469#section-2.4
+type hostPin struct {
+	pattern string
+	digest  string
+}
+
+// hostClientCert is the client certificate presented to upstream servers matching pattern.
+type hostClientCert struct {
+	pattern string
+	name    string
+	cert    *tls.Certificate
+}
+
+// newTLSPolicy creates policy from command line values:
+// rootsFile is a pem bundle of extra root certificates, insecureHosts is a list of host patterns,
+// pins is a list of 'pattern=sha256/base64' items, and clientCerts is a list of 'pattern=cert.pem[;key.pem]' items.
+func newTLSPolicy(rootsFile string, insecureHosts string, pins string, clientCerts string) (p *tlsPolicy, err error) {
+	p = &tlsPolicy{insecureHosts: splitList(insecureHosts)}
+	if rootsFile != "" {
+		if p.roots, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("x509.SystemCertPool: %w", err)
+		}
+		fpath, err := fsutil.ExpandHomeDir(rootsFile)
+		if err != nil {
+			return nil, fmt.Errorf("fsutil.ExpandHomeDir: %w", err)
+		}
+		data, err := os.ReadFile(fpath)
+		if err != nil {
+			return nil, fmt.Errorf("os.ReadFile: %w", err)
+		}
+		if !p.roots.AppendCertsFromPEM(data) {
+			return nil, errors.New("proxy: no certificate found in " + fpath)
+		}
+	}
+	for _, item := range splitList(pins) {
+		pattern, digest, ok := strings.Cut(item, "=")
+		digest = strings.TrimPrefix(digest, "sha256/")
+		if raw, err := base64.StdEncoding.DecodeString(digest); !ok || err != nil || len(raw) != sha256.Size {
+			return nil, errors.New("proxy: invalid upstream pin: " + item)
+		}
+		p.pins = append(p.pins, hostPin{pattern: pattern, digest: digest})
+	}
+	for _, item := range splitList(clientCerts) {
+		pattern, files, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, errors.New("proxy: invalid client certificate: " + item)
+		}
+		certFile, keyFile, ok := strings.Cut(files, ";")
+		if !ok {
+			keyFile = certFile // both certificate and private key are in the same file
+		}
+		if certFile, err = fsutil.ExpandHomeDir(certFile); err != nil {
+			return nil, fmt.Errorf("fsutil.ExpandHomeDir: %w", err)
+		}
+		if keyFile, err = fsutil.ExpandHomeDir(keyFile); err != nil {
+			return nil, fmt.Errorf("fsutil.ExpandHomeDir: %w", err)
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls.LoadX509KeyPair: %w", err)
+		}
+		p.clientCerts = append(p.clientCerts, hostClientCert{pattern: pattern, name: cert.Leaf.Subject.String(), cert: &cert})
+	}
+	return p, nil
+}
+
+// tlsConfig returns client config for upstream connection to host.
+// Empty host is used for the default http.Transport, which fills ServerName by itself.
+func (p *tlsPolicy) tlsConfig(host string) *tls.Config {
+	if host == "" {
+		return &tls.Config{RootCAs: p.roots}
+	}
+	config := p.policyFor(host).tlsConfig(p.roots)
+	config.ServerName = host
+	return config
+}
+
+// transport returns http.Transport derived from base with the policy of host. ServerName of tls.ConnectionState is empty for ip address,
+// so policy cannot be checked in a shared VerifyConnection callback, and each special policy gets its own transport.
+// ServerName is left to http.Transport, so hosts matching the same policy share one transport.
+func (p *tlsPolicy) transport(base *http.Transport, host string) *http.Transport {
+	if !p.special(host) {
+		return base
+	}
+	key := transportKey{base, p.policyFor(host)}
+	if t, ok := p.transports.Load(key); ok {
+		return t.(*http.Transport)
+	}
+	t := base.Clone()
+	t.TLSClientConfig = key.policy.tlsConfig(p.roots)
+	actual, _ := p.transports.LoadOrStore(key, t)
+	return actual.(*http.Transport)
+}
+
+type transportKey struct {
+	base   *http.Transport
+	policy hostPolicy
+}
+
+// hostPolicy is the policy matched by a host. It is comparable, so the number of transports is bounded by configured patterns instead of hosts.
+type hostPolicy struct {
+	insecure   bool
+	pins       string // comma separated digests
+	clientCert *hostClientCert
+}
+
+func (p *tlsPolicy) policyFor(host string) hostPolicy {
+	return hostPolicy{
+		insecure:   p.insecure(host),
+		pins:       strings.Join(p.pinsFor(host), ","),
+		clientCert: p.clientCertFor(host),
+	}
+}
+
+// tlsConfig returns client config of policy without ServerName.
+func (hp hostPolicy) tlsConfig(roots *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		RootCAs:            roots,
+		InsecureSkipVerify: hp.insecure,
+	}
+	if hp.pins != "" {
+		pins := strings.Split(hp.pins, ",")
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return checkPins(pins, pinnableChains(cs.VerifiedChains, cs.PeerCertificates))
+		}
+	}
+	if cc := hp.clientCert; cc != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			global.LOG.Debugf(context.Background(), "proxy: present client certificate %s to %s", cc.name, cc.pattern)
+			return cc.cert, nil
+		}
+	}
+	return config
+}
+
+func (p *tlsPolicy) special(host string) bool {
+	return p.insecure(host) || len(p.pinsFor(host)) > 0 || p.clientCertFor(host) != nil
+}
+
+func (p *tlsPolicy) insecure(host string) bool {
+	return matchHostAny(p.insecureHosts, host)
+}
+
+func (p *tlsPolicy) pinsFor(host string) (digests []string) {
+	if host == "" {
+		return nil
+	}
+	for _, pin := range p.pins {
+		if matchHost(pin.pattern, host) {
+			digests = append(digests, pin.digest)
+		}
+	}
+	return digests
+}
+
+// clientCertFor returns the first client certificate whose pattern matches host.
+func (p *tlsPolicy) clientCertFor(host string) *hostClientCert {
+	if host == "" {
+		return nil
+	}
+	for i := range p.clientCerts {
+		if matchHost(p.clientCerts[i].pattern, host) {
+			return &p.clientCerts[i]
+		}
+	}
+	return nil
+}
+
+// verify checks certificates fetched from upstream server in the same way as crypto/tls.
+// Pins are always checked even if host is insecure, so a self-signed server can be trusted by pin only.
+// https://cs.opensource.google/go/go/+/refs/tags/go1.24.3:src/crypto/tls/handshake_client.go;l=1108
+func (p *tlsPolicy) verify(host string, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errMissingCertificate
+	}
+	var chains [][]*x509.Certificate
+	if !p.insecure(host) {
+		opts := x509.VerifyOptions{
+			Roots:         p.roots,
+			DNSName:       host,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		var err error
+		if chains, err = certs[0].Verify(opts); err != nil {
+			return err
+		}
+	}
+	if pins := p.pinsFor(host); len(pins) > 0 {
+		return checkPins(pins, pinnableChains(chains, certs))
+	}
+	return nil
+}
+
+const (
+	upstreamCertTTL  = 5 * time.Minute
+	upstreamCertSize = 1024
+)
+
+type upstreamCertKey struct {
+	addr       string
+	sni        string
+	serverName string
+}
+
+// upstreamCert is certificate chain fetched from upstream server, and the result of verifying it.
+type upstreamCert struct {
+	certs     []*x509.Certificate
+	verifyErr error
+	until     time.Time
+}
+
+// upstreamCertCache keeps fetched upstream certificates for upstreamCertTTL, and it is reset if it is full of unexpired entries.
+type upstreamCertCache struct {
+	entries map[upstreamCertKey]*upstreamCert
+	mu      sync.Mutex
+}
+
+func (c *upstreamCertCache) load(key upstreamCertKey) (*upstreamCert, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	upstream, ok := c.entries[key]
+	return upstream, ok && time.Now().Before(upstream.until)
+}
+
+func (c *upstreamCertCache) store(key upstreamCertKey, upstream *upstreamCert) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.entries == nil {
+		c.entries = make(map[upstreamCertKey]*upstreamCert)
+	} else if len(c.entries) >= upstreamCertSize {
+		for k, v := range c.entries {
+			if !now.Before(v.until) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= upstreamCertSize {
+			clear(c.entries)
+		}
+	}
+	upstream.until = now.Add(upstreamCertTTL)
+	c.entries[key] = upstream
+}
+
+// pinnableChains returns the chains that pins can be matched against.
+// Certificates sent by server are untrusted, as anyone can append the pinned certificate to a forged chain,
+// so only the verified chains are used, or only the leaf if chains are not verified for insecure host.
+func pinnableChains(verified [][]*x509.Certificate, peer []*x509.Certificate) [][]*x509.Certificate {
+	if len(verified) > 0 {
+		return verified
+	} else if len(peer) > 0 {
+		return [][]*x509.Certificate{peer[:1]}
+	}
+	return nil
+}
+
+// checkPins succeeds if any certificate in chains matches any of the pins.
+func checkPins(pins []string, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			digest := base64.StdEncoding.EncodeToString(sum[:])
+			for _, pin := range pins {
+				if digest == pin {
+					return nil
+				}
+			}
+		}
+	}
+	return errPinMismatch
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCert issues certificate for name signed by parent, or self-signed if parent is nil.
+func newTestCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{name}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func testPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// handshakeTestPolicy serves certs to a client with tls config of policy for host, and returns the client handshake error.
+func handshakeTestPolicy(p *tlsPolicy, host string, certs []*x509.Certificate, key crypto.Signer) error {
+	serverCert := &tls.Certificate{PrivateKey: key}
+	for _, cert := range certs {
+		serverCert.Certificate = append(serverCert.Certificate, cert.Raw)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0") // net.Pipe is unbuffered, and alert of client blocks while server is writing
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*serverCert}}).Handshake()
+		}
+	}()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer clientConn.Close()
+	return tls.Client(clientConn, p.tlsConfig(host)).Handshake()
+}
+
+func TestTLSPolicyPins(t *testing.T) {
+	pinnedRoot, pinnedRootKey := newTestCert(t, "pinned root", true, nil, nil)
+	otherRoot, otherRootKey := newTestCert(t, "other root", true, nil, nil)
+	pinnedLeaf, pinnedLeafKey := newTestCert(t, "secure.test", false, pinnedRoot, pinnedRootKey)
+	otherLeaf, otherLeafKey := newTestCert(t, "secure.test", false, otherRoot, otherRootKey)
+	selfSigned, selfSignedKey := newTestCert(t, "insecure.test", false, nil, nil)
+	forged, forgedKey := newTestCert(t, "insecure.test", false, nil, nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pinnedRoot)
+	roots.AddCert(otherRoot)
+	p := &tlsPolicy{
+		roots:         roots,
+		insecureHosts: []string{"insecure.test"},
+		pins:          []hostPin{{"secure.test", testPin(pinnedRoot)}, {"insecure.test", testPin(selfSigned)}},
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		certs   []*x509.Certificate
+		key     crypto.Signer
+		wantErr error
+	}{
+		{"pinned root", "secure.test", []*x509.Certificate{pinnedLeaf}, pinnedLeafKey, nil},
+		{"other root", "secure.test", []*x509.Certificate{otherLeaf}, otherLeafKey, errPinMismatch},
+		{"other root with pinned root appended", "secure.test", []*x509.Certificate{otherLeaf, pinnedRoot}, otherLeafKey, errPinMismatch},
+		{"pinned self-signed", "insecure.test", []*x509.Certificate{selfSigned}, selfSignedKey, nil},
+		{"forged with pinned appended", "insecure.test", []*x509.Certificate{forged, selfSigned}, forgedKey, errPinMismatch},
+	}
+	for _, tt := range tests {
+		if err := p.verify(tt.host, tt.certs); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: verify() = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if err := handshakeTestPolicy(p, tt.host, tt.certs, tt.key); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: handshake error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestUpstreamCertificatesCached(t *testing.T) {
+	cert, key := newTestCert(t, "upstream.test", false, nil, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}})
+			tlsConn.Handshake()
+			tlsConn.Close()
+		}
+	}()
+
+	s := &Server{tlsPolicy: &tlsPolicy{}}
+	if s.router, err = newRouter("", "", "", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	for range 3 {
+		upstream, err := s.upstreamCertificates(context.Background(), addr, "upstream.test", "upstream.test")
+		if err != nil {
+			t.Fatalf("upstreamCertificates: %v", err)
+		} else if !upstream.certs[0].Equal(cert) || upstream.verifyErr == nil {
+			t.Fatalf("upstreamCertificates = %v, %v, want self-signed certificate and verify error", upstream.certs[0].Subject, upstream.verifyErr)
+		}
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("upstream accepted %d connections, want 1", n)
+	}
+
+	if _, err = s.upstreamCertificates(context.Background(), addr, "other.test", "other.test"); err != nil {
+		t.Fatalf("upstreamCertificates: %v", err)
+	} else if n := accepted.Load(); n != 2 {
+		t.Errorf("upstream accepted %d connections for another sni, want 2", n)
+	}
+
+	ln.Close()
+	if _, err = s.upstreamCertificates(context.Background(), addr, "down.test", "down.test"); err == nil {
+		t.Error("upstreamCertificates succeeded for closed upstream, want error")
+	} else if _, ok := s.upstreamCerts.load(upstreamCertKey{addr, "down.test", "down.test"}); ok {
+		t.Error("upstreamCertificates cached the fetch error")
+	}
+}
+
+func TestTLSPolicyTransport(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	otherCert, _ := newTestCert(t, "other", false, nil, nil)
+
+	p := &tlsPolicy{
+		insecureHosts: []string{"127.0.0.1", "*.insecure.test"},
+		pins:          []hostPin{{"127.0.0.1", testPin(ts.Certificate())}, {"pinned.insecure.test", testPin(otherCert)}},
+	}
+	base := &http.Transport{}
+	if got := p.transport(base, "secure.test"); got != base {
+		t.Error("transport() of host without special policy is not base")
+	}
+	if p.transport(base, "a.insecure.test") != p.transport(base, "b.insecure.test") {
+		t.Error("transport() of hosts with the same policy differs")
+	}
+	if p.transport(base, "a.insecure.test") == p.transport(base, "pinned.insecure.test") {
+		t.Error("transport() of hosts with different pins is shared")
+	}
+	n := 0
+	p.transports.Range(func(any, any) bool { n++; return true })
+	if n != 2 {
+		t.Errorf("transports has %d entries, want 2", n)
+	}
+
+	res, err := (&http.Client{Transport: p.transport(base, "127.0.0.1")}).Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Get() with pinned transport: %v", err)
+	}
+	res.Body.Close()
+	p.pins[0].digest = testPin(otherCert)
+	p.transports.Clear()
+	if _, err = (&http.Client{Transport: p.transport(base, "127.0.0.1")}).Get(ts.URL); !errors.Is(err, errPinMismatch) {
+		t.Errorf("Get() with mismatched pin = %v, want %v", err, errPinMismatch)
+	}
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whoisnian/glp/global"
+)
+
+// https://www.rfc-editor.org/rfc/rfc6455#section-5.2
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsCloseTimeout = 5 * time.Second
+)
+
+var wsOpNames = map[byte]string{
+	wsOpContinuation: "continuation",
+	wsOpText:         "text",
+	wsOpBinary:       "binary",
+	wsOpClose:        "close",
+	wsOpPing:         "ping",
+	wsOpPong:         "pong",
+}
+
+func wsOpName(op byte) string {
+	if name, ok := wsOpNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", op)
+}
+
+// handleUpgrade relays the connection after upstream switches protocols with 101 response.
+// Websocket frames are parsed and logged in both directions, and other protocols are copied as is.
+func (s *Server) handleUpgrade(conn net.Conn, req *http.Request, res *http.Response) {
+	upstream, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		global.LOG.Errorf(req.Context(), "proxy: handleUpgrade %s %s non-writable body for 101 response", req.Method, req.URL)
+		return
+	}
+	defer upstream.Close()
+	if err := writeResponseHead(conn, res); err != nil {
+		global.LOG.Errorf(req.Context(), "proxy: handleUpgrade %s %s %s", req.Method, req.URL, err.Error())
+		return
+	}
+	stop := context.AfterFunc(req.Context(), func() {
+		upstream.Close()
+		conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	clientReader := bufio.NewReader(conn)
+	if bc, ok := conn.(*BufioConn); ok {
+		clientReader = bc.Reader()
+	}
+	if !strings.EqualFold(res.Header.Get("Upgrade"), "websocket") {
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		go func() {
+			io.Copy(conn, upstream)
+			conn.SetReadDeadline(time.Unix(1, 0))
+			wg.Done()
+		}()
+		clientReader.WriteTo(upstream)
+		upstream.Close()
+		wg.Wait()
+		return
+	}
+
+	upstreamReader := newBufioReader(upstream)
+	defer putBufioReader(upstreamReader)
+
+	// A direction ends cleanly after forwarding a close frame, and the other direction has wsCloseTimeout to reply.
+	// Otherwise the other direction is interrupted immediately.
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := s.relayFrames(req, conn, upstreamReader, "server"); err != nil {
+			conn.SetReadDeadline(time.Unix(1, 0))
+		} else {
+			conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+		}
+	}()
+	if err := s.relayFrames(req, upstream, clientReader, "client"); err != nil {
+		upstream.Close()
+	} else {
+		timer := time.AfterFunc(wsCloseTimeout, func() { upstream.Close() })
+		defer timer.Stop()
+	}
+	wg.Wait()
+}
+
+// relayFrames forwards websocket frames from src to dst without modification, until a close frame is forwarded.
+// Data messages are logged when their final fragment is forwarded, and control frames are logged immediately.
+func (s *Server) relayFrames(req *http.Request, dst io.Writer, src *bufio.Reader, from string) error {
+	var (
+		header  [14]byte
+		control [125]byte
+		msgOp   byte
+		msgSize int64
+	)
+	for {
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return err
+		}
+		fin, op, masked := header[0]&0x80 != 0, header[0]&0x0f, header[1]&0x80 != 0
+		n, size := 2, int64(header[1]&0x7f)
+		if size == 126 {
+			if _, err := io.ReadFull(src, header[n:n+2]); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint16(header[n:]))
+			n += 2
+		} else if size == 127 {
+			if _, err := io.ReadFull(src, header[n:n+8]); err != nil {
+				return err
+			}
+			if size = int64(binary.BigEndian.Uint64(header[n:])); size < 0 {
+				return errors.New("proxy: invalid websocket frame length")
+			}
+			n += 8
+		}
+		var mask []byte
+		if masked {
+			if _, err := io.ReadFull(src, header[n:n+4]); err != nil {
+				return err
+			}
+			mask = header[n : n+4]
+			n += 4
+		}
+		if _, err := dst.Write(header[:n]); err != nil {
+			return err
+		}
+
+		if op < wsOpClose { // data frame
+			if _, err := io.CopyN(dst, src, size); err != nil {
+				return err
+			}
+			if op != wsOpContinuation {
+				msgOp, msgSize = op, 0
+			}
+			if msgSize += size; fin {
+				global.LOG.Info(req.Context(), "",
+					global.LogAttrTag("WS"),
+					global.LogAttrURL(req.URL),
+					slog.String("from", from),
+					slog.String("opcode", wsOpName(msgOp)),
+					slog.Int64("size", msgSize),
+				)
+			}
+			continue
+		}
+
+		// control frame: https://www.rfc-editor.org/rfc/rfc6455#section-5.5
+		if !fin || size > int64(len(control)) {
+			return errors.New("proxy: invalid websocket control frame")
+		}
+		payload := control[:size]
+		if _, err := io.ReadFull(src, payload); err != nil {
+			return err
+		}
+		if _, err := dst.Write(payload); err != nil {
+			return err
+		}
+		if op != wsOpClose {
+			global.LOG.Debug(req.Context(), "",
+				global.LogAttrTag("WS"),
+				global.LogAttrURL(req.URL),
+				slog.String("from", from),
+				slog.String("opcode", wsOpName(op)),
+				slog.Int64("size", size),
+			)
+			continue
+		}
+
+		for i := range payload {
+			if masked {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		var code uint16
+		if len(payload) >= 2 {
+			code, payload = binary.BigEndian.Uint16(payload), payload[2:]
+		}
+		global.LOG.Info(req.Context(), "",
+			global.LogAttrTag("WS"),
+			global.LogAttrURL(req.URL),
+			slog.String("from", from),
+			slog.String("opcode", wsOpName(op)),
+			slog.Int("code", int(code)),
+			slog.String("reason", string(payload)),
+		)
+		return nil
+	}
+}
+
+// writeResponseHead writes status line and headers of res, and leaves body to caller.
+func writeResponseHead(w io.Writer, res *http.Response) error {
+	buf := newBuffer()
+	defer putBuffer(buf)
+
+	fmt.Fprintf(buf, "HTTP/1.1 %s\r\n", res.Status)
+	res.Header.Write(buf)
+	buf.WriteString("\r\n")
+	_, err := buf.WriteTo(w)
+	return err
+}